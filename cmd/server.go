@@ -3,6 +3,7 @@ package cmd
 import (
 	"os"
 	"runtime"
+	"time"
 
 	"github.com/rauljordan/eth-faucet/internal"
 	"github.com/sirupsen/logrus"
@@ -27,16 +28,19 @@ var (
 			if err := viper.Unmarshal(&cfg); err != nil {
 				log.Fatal(err)
 			}
-			if cfg.CaptchaHost == "" {
+			// Requests can be verified with proof of work instead of a captcha,
+			// and captcha sites can be configured in the config file instead.
+			if cfg.CaptchaHost == "" && len(cfg.CaptchaSites) == 0 && !cfg.PowEnabled {
 				log.Fatal("--captcha-host required")
 			}
-			if cfg.CaptchaSecret == "" {
+			if cfg.CaptchaSecret == "" && len(cfg.CaptchaSites) == 0 && !cfg.PowEnabled {
 				log.Fatal("--captcha-secret required")
 			}
 			if cfg.Web3Provider == "" {
 				log.Fatal("--web3-provider endpoint required")
 			}
-			if cfg.PrivateKey == "" {
+			// The funder key can also be loaded from a keystore or held by a remote signer.
+			if cfg.PrivateKey == "" && len(cfg.PrivateKeys) == 0 && cfg.KeystorePath == "" && cfg.RemoteSignerURL == "" {
 				log.Fatal("--private-key hex string required")
 			}
 			srv, err := internal.NewServer(cfg)
@@ -58,15 +62,65 @@ func init() {
 	rootCmd.Flags().Int("http-port", 8000, "Port to serve REST http requests")
 	rootCmd.Flags().String("http-host", "127.0.0.1", "Host to serve REST http requests")
 	rootCmd.Flags().StringSlice("allowed-origins", []string{"*"}, "Allowed origins for REST http requests, comma-separated")
+	rootCmd.Flags().String("metrics-host", "127.0.0.1", "Host to serve prometheus metrics")
+	rootCmd.Flags().Int("metrics-port", 0, "Port to serve prometheus metrics (0 disables the metrics server)")
+	rootCmd.Flags().String("captcha-provider", "recaptcha-v3", "Captcha provider verifying requests (recaptcha-v3, recaptcha-v2, hcaptcha, turnstile)")
+	rootCmd.Flags().String("captcha-verify-url", "", "Overrides the siteverify endpoint of the captcha provider (optional)")
 	rootCmd.Flags().String("captcha-host", "", "Host for the captcha validation")
 	rootCmd.Flags().String("captcha-secret", "", "Secret for captcha validation")
-	rootCmd.Flags().Float64("captcha-min-score", 0.9, "Minimum passing captcha score")
+	rootCmd.Flags().Float64("captcha-min-score", 0.9, "Minimum passing captcha score (recaptcha-v3 only)")
+	rootCmd.Flags().Int("captcha-replay-cache-size", 100000, "Max number of unexpired captcha tokens and proof-of-work challenges the memory rate limiter remembers to reject their reuse, refusing further ones once full (bolt persists them across restarts, redis shares them between replicas)")
+	rootCmd.Flags().Int("captcha-failures-per-ip", 10, "Failed captchas after which an ip is temporarily banned (0 disables the bans)")
+	rootCmd.Flags().Int("captcha-failures-per-address", 0, "Failed captchas naming an address after which the address is temporarily banned, from every ip (0 disables the bans)")
+	rootCmd.Flags().Duration("captcha-failure-window", time.Hour, "Time without failed captchas after which a client's failures and bans are forgiven")
+	rootCmd.Flags().Duration("captcha-ban-duration", 10*time.Minute, "Duration of the first captcha ban, doubling with every further ban")
+	rootCmd.Flags().Duration("captcha-max-ban-duration", 24*time.Hour, "Max duration of a captcha ban")
+	rootCmd.Flags().Bool("pow-enabled", false, "Verify requests with self-hosted proof-of-work challenges, making the captcha optional")
+	rootCmd.Flags().String("pow-secret", "", "Secret signing proof-of-work challenges, shared between faucet replicas (random if empty)")
+	rootCmd.Flags().Int("pow-difficulty", 20, "Number of leading zero bits a proof-of-work solution needs")
+	rootCmd.Flags().Int("pow-max-difficulty", 24, "Max number of leading zero bits a proof-of-work solution needs under load")
+	rootCmd.Flags().Int("pow-target-per-minute", 60, "Challenges issued per minute above which the proof-of-work difficulty rises (0 disables it)")
+	rootCmd.Flags().Duration("pow-challenge-ttl", 5*time.Minute, "Time a proof-of-work challenge can be solved in")
 	rootCmd.Flags().String("web3-provider", "http://localhost:8545", "HTTP web3provider endpoint to an Ethereum node")
 	rootCmd.Flags().String("private-key", "", "Private key hex string of the funder of the faucet")
+	rootCmd.Flags().StringSlice("private-keys", nil, "Private key hex strings of further funders of the faucet")
+	rootCmd.Flags().String("funder-strategy", "balance", "Funder paying for each request (balance picks the one with the most balance, pending the one with the fewest pending transactions)")
+	rootCmd.Flags().String("keystore-path", "", "Path to an encrypted keystore file holding the key of a funder")
+	rootCmd.Flags().String("keystore-password-file", "", "Path to the file holding the password of the keystore")
+	rootCmd.Flags().String("remote-signer-url", "", "Url of a remote signer signing for funders over its eth_signTransaction api, such as Clef or Web3Signer")
+	rootCmd.Flags().StringSlice("remote-signer-accounts", nil, "Funder addresses held by the remote signer (all accounts it lists if empty)")
+	rootCmd.Flags().String("min-funder-balance", "0", "Balance in wei below which a funder is skipped (funders always need the funding amount)")
 	rootCmd.Flags().String("funding-amount", "32500000000000000000", "Amount in wei to fund with each request")
 	rootCmd.Flags().Uint64("gas-limit", 40000, "Gas limit for funding transactions")
+	rootCmd.Flags().String("tx-type", "auto", "Type of funding transactions (auto, dynamic, legacy). auto sends dynamic fee transactions once the chain supports them")
+	rootCmd.Flags().String("max-fee-per-gas", "100000000000", "Max fee per gas in wei a funding transaction pays, also capping the gas price of legacy transactions")
+	rootCmd.Flags().String("max-priority-fee-per-gas", "2000000000", "Max priority fee per gas in wei a dynamic fee funding transaction tips")
+	rootCmd.Flags().Bool("async-funding", false, "Answer funding requests as soon as their transaction is broadcast instead of once it mined")
+	rootCmd.Flags().Duration("funding-status-retention", 24*time.Hour, "How long the status of a finished funding request can be polled")
+	rootCmd.Flags().Int("confirmations", 1, "Number of blocks deep, counting its own block, a funding transaction needs to be before it is confirmed")
+	rootCmd.Flags().Duration("replace-after", 2*time.Minute, "Time a funding transaction can be pending before it is replaced with bumped fees (0 disables replacements)")
+	rootCmd.Flags().String("max-replacement-fee-per-gas", "500000000000", "Max fee per gas in wei a replacement of a stuck funding transaction pays")
+	rootCmd.Flags().Duration("max-funding-wait", 10*time.Minute, "Max time a funding request waits for its transaction to be confirmed (0 waits forever)")
 	rootCmd.Flags().Int64("chain-id", 5, "Chain ID for Ethereum (5 is the Goerli test network)")
-	rootCmd.Flags().Int("ip-limit-per-address", 5, "Number of ip's allowed per funding address")
+	rootCmd.Flags().Int("ip-limit-per-address", 5, "Number of distinct ip's allowed per funding address within the limit window (0 disables the limit)")
+	rootCmd.Flags().Int("address-limit-per-ip", 5, "Number of distinct funding addresses allowed per ip within the limit window (0 disables the limit)")
+	rootCmd.Flags().Int("address-limit-per-subnet", 20, "Number of distinct funding addresses allowed per ip subnet within the limit window (0 disables the limit)")
+	rootCmd.Flags().Int("ipv4-prefix-length", 24, "Prefix length grouping ipv4 addresses into a subnet")
+	rootCmd.Flags().Int("ipv6-prefix-length", 64, "Prefix length grouping ipv6 addresses into a subnet")
+	rootCmd.Flags().Int("trusted-proxies", 0, "Number of reverse proxies in front of the http gateway whose X-Forwarded-For hops are trusted")
+	rootCmd.Flags().Duration("limit-window", 24*time.Hour, "Sliding window in which the per-address and per-ip limits are counted")
+	rootCmd.Flags().Duration("address-cooldown", 24*time.Hour, "Time an address has to wait before it can be funded again")
+	rootCmd.Flags().String("budget-max-wei", "", "Max amount in wei each faucet replica sends within the budget window, at least the funding amount (empty disables the limit)")
+	rootCmd.Flags().Duration("budget-window", 24*time.Hour, "Rolling window of the faucet spending budget")
+	rootCmd.Flags().Int("budget-max-tx-per-minute", 0, "Max number of funding transactions each faucet replica sends per minute (0 disables the limit)")
+	rootCmd.Flags().String("allowlist-path", "", "Path to a file of ETH addresses, ip addresses and CIDR ranges which skip the rate limits, one per line")
+	rootCmd.Flags().String("denylist-path", "", "Path to a file of ETH addresses, ip addresses and CIDR ranges which are denied funding, one per line")
+	rootCmd.Flags().String("api-keys-path", "", "Path to a file of api keys skipping the captcha, listing a name, the sha256 hash of the key and an optional quota per line")
+	rootCmd.Flags().Int("api-key-quota", 100, "Number of funding requests an api key without a quota of its own can make within the api key window, shared by replicas using the redis rate limiter (0 disables the quota)")
+	rootCmd.Flags().Duration("api-key-window", 24*time.Hour, "Sliding window in which the api key quotas are counted")
+	rootCmd.Flags().String("rate-limiter", "memory", "Rate limiter backend to use (memory, bolt, redis)")
+	rootCmd.Flags().String("rate-limiter-db-path", "faucet.db", "Path to the database file used by the bolt rate limiter")
+	rootCmd.Flags().String("redis-url", "redis://localhost:6379/0", "Redis url used by the redis rate limiter")
 
 	// Bind all flags to a viper configuration.
 	if err := viper.BindPFlags(rootCmd.Flags()); err != nil {
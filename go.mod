@@ -3,15 +3,18 @@ module github.com/rauljordan/eth-faucet
 go 1.15
 
 require (
-	github.com/ethereum/go-ethereum v1.10.2
+	github.com/alicebob/miniredis/v2 v2.14.3
+	github.com/ethereum/go-ethereum v1.10.8
+	github.com/fsnotify/fsnotify v1.4.9
+	github.com/go-redis/redis/v8 v8.4.11
 	github.com/golang/protobuf v1.4.3
 	github.com/grpc-ecosystem/grpc-gateway/v2 v2.0.0
-	github.com/prestonvanloon/go-recaptcha v0.0.0-20190217191114-0834cef6e8bd
-	github.com/rauljordan/minimal-grpc-gateway v0.0.0-20201017192135-199fa853d2e0
+	github.com/prometheus/client_golang v1.10.0
+	github.com/rs/cors v1.7.0
 	github.com/sirupsen/logrus v1.7.0
-	github.com/spf13/afero v1.1.2 // indirect
 	github.com/spf13/cobra v1.1.3
 	github.com/spf13/viper v1.7.1
+	go.etcd.io/bbolt v1.3.5
 	google.golang.org/genproto v0.0.0-20201015140912-32ed001d685c
 	google.golang.org/grpc v1.33.0
 	google.golang.org/protobuf v1.25.0
@@ -0,0 +1,244 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	denylisted            = "DENYLISTED"
+	accessListReloadDelay = 100 * time.Millisecond
+)
+
+// Access lists hold the addresses and ip ranges which are always denied
+// funding, and those which skip the rate limits. Both lists are loaded from
+// files listing an ETH address, ip address or CIDR range per line, and are
+// reloaded whenever the files change or a reload signal is received.
+type accessLists struct {
+	allowlistPath string
+	denylistPath  string
+	mutex         sync.RWMutex
+	allow         *accessList
+	deny          *accessList
+}
+
+type accessList struct {
+	addresses map[common.Address]bool
+	networks  []*net.IPNet
+}
+
+func newAccessLists(allowlistPath, denylistPath string) (*accessLists, error) {
+	l := &accessLists{
+		allowlistPath: allowlistPath,
+		denylistPath:  denylistPath,
+	}
+	if err := l.reload(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Whether the ip address or ETH address is denied funding. The ip address
+// needs to be the client ip trusted by getIPAddress, never a hop the client
+// could have set itself.
+func (l *accessLists) denied(ipAddress string, ethAddress common.Address) bool {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	return l.deny.contains(ipAddress, ethAddress)
+}
+
+// Whether the ip address or ETH address skips the rate limits. Like for the
+// denylist, the ip address needs to be the trusted client ip.
+func (l *accessLists) allowed(ipAddress string, ethAddress common.Address) bool {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	return l.allow.contains(ipAddress, ethAddress)
+}
+
+// Reloads both lists from their files. The current lists are kept if either
+// file cannot be loaded.
+func (l *accessLists) reload() error {
+	allow, err := loadAccessList(l.allowlistPath)
+	if err != nil {
+		return fmt.Errorf("could not load allowlist: %w", err)
+	}
+	deny, err := loadAccessList(l.denylistPath)
+	if err != nil {
+		return fmt.Errorf("could not load denylist: %w", err)
+	}
+	l.mutex.Lock()
+	l.allow = allow
+	l.deny = deny
+	l.mutex.Unlock()
+	log.WithFields(logrus.Fields{
+		"allowedAddresses": len(allow.addresses),
+		"allowedNetworks":  len(allow.networks),
+		"deniedAddresses":  len(deny.addresses),
+		"deniedNetworks":   len(deny.networks),
+	}).Info("Loaded access lists")
+	return nil
+}
+
+// Reloads the lists whenever their files change or a reload signal is received.
+func (l *accessLists) watch(ctx context.Context) {
+	var paths []string
+	for _, path := range []string{l.allowlistPath, l.denylistPath} {
+		if path != "" {
+			paths = append(paths, filepath.Clean(path))
+		}
+	}
+	if len(paths) == 0 {
+		return
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.WithError(err).Error("Could not watch access lists")
+		return
+	}
+	defer func() {
+		if err := watcher.Close(); err != nil {
+			log.WithError(err).Error("Could not stop watching access lists")
+		}
+	}()
+	// Watch the directories rather than the files, so lists replaced by
+	// editors or config management tools keep being watched.
+	for _, path := range paths {
+		if err := watcher.Add(filepath.Dir(path)); err != nil {
+			log.WithError(err).Errorf("Could not watch access list %s", path)
+		}
+	}
+
+	sigc := make(chan os.Signal, 1)
+	if len(reloadSignals) > 0 {
+		signal.Notify(sigc, reloadSignals...)
+		defer signal.Stop(sigc)
+	}
+	// Files are usually truncated before they are written, so wait for the
+	// events of a change to settle before reloading.
+	debounce := time.NewTimer(0)
+	<-debounce.C
+	defer debounce.Stop()
+	for {
+		select {
+		case event := <-watcher.Events:
+			if !isWatchedPath(paths, event.Name) || event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+				continue
+			}
+			if !debounce.Stop() {
+				select {
+				case <-debounce.C:
+				default:
+				}
+			}
+			debounce.Reset(accessListReloadDelay)
+		case <-debounce.C:
+			if err := l.reload(); err != nil {
+				log.WithError(err).Error("Could not reload access lists")
+			}
+		case err := <-watcher.Errors:
+			log.WithError(err).Error("Error watching access lists")
+		case <-sigc:
+			if err := l.reload(); err != nil {
+				log.WithError(err).Error("Could not reload access lists")
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Converts a denial into a gRPC status.
+func denylistedStatus(ipAddress string, ethAddress common.Address) *status.Status {
+	msg := fmt.Sprintf("Request from %s for %s is denied", ipAddress, ethAddress.Hex())
+	return deniedStatus(codes.PermissionDenied, msg, denylisted, time.Time{})
+}
+
+func isWatchedPath(paths []string, name string) bool {
+	name = filepath.Clean(name)
+	for _, path := range paths {
+		if path == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *accessList) contains(ipAddress string, ethAddress common.Address) bool {
+	if l.addresses[ethAddress] {
+		return true
+	}
+	ip := net.ParseIP(ipAddress)
+	if ip == nil {
+		return false
+	}
+	for _, network := range l.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Loads an access list file. Blank lines and anything after a # are ignored.
+// An empty path loads an empty list.
+func loadAccessList(path string) (*accessList, error) {
+	l := &accessList{addresses: make(map[common.Address]bool)}
+	if path == "" {
+		return l, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			log.WithError(err).Errorf("Could not close access list %s", path)
+		}
+	}()
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		entry := strings.TrimSpace(strings.SplitN(scanner.Text(), "#", 2)[0])
+		if entry == "" {
+			continue
+		}
+		if err := l.add(entry); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNum, err)
+		}
+	}
+	return l, scanner.Err()
+}
+
+func (l *accessList) add(entry string) error {
+	if common.IsHexAddress(entry) {
+		l.addresses[common.HexToAddress(entry)] = true
+		return nil
+	}
+	if _, network, err := net.ParseCIDR(entry); err == nil {
+		l.networks = append(l.networks, network)
+		return nil
+	}
+	ip := net.ParseIP(normalizeIP(entry))
+	if ip == nil {
+		return fmt.Errorf("%q is neither an ETH address, ip address nor CIDR range", entry)
+	}
+	bits := 8 * net.IPv6len
+	if v4 := ip.To4(); v4 != nil {
+		ip, bits = v4, 8*net.IPv4len
+	}
+	l.networks = append(l.networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	return nil
+}
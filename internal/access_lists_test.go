@@ -0,0 +1,88 @@
+package internal
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func writeAccessList(t *testing.T, dir, name, contents string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func Test_loadAccessList(t *testing.T) {
+	path := writeAccessList(t, t.TempDir(), "list", strings.Join([]string{
+		"# CI wallets",
+		"0x0101010101010101010101010101010101010101",
+		"",
+		"  192.0.0.1  # single ip",
+		"10.0.0.0/8",
+		"2001:db8::/32",
+	}, "\n"))
+	l, err := loadAccessList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		ipAddress  string
+		ethAddress string
+		want       bool
+	}{
+		{"192.0.0.2", "0x0101010101010101010101010101010101010101", true},
+		{"192.0.0.1", "0x0202020202020202020202020202020202020202", true},
+		{"192.0.0.2", "0x0202020202020202020202020202020202020202", false},
+		{"10.200.0.1", "0x0202020202020202020202020202020202020202", true},
+		{"2001:db8:1::1", "0x0202020202020202020202020202020202020202", true},
+		{"2001:db9::1", "0x0202020202020202020202020202020202020202", false},
+	}
+	for _, tt := range tests {
+		if got := l.contains(tt.ipAddress, common.HexToAddress(tt.ethAddress)); got != tt.want {
+			t.Errorf("contains(%s, %s) = %v, want %v", tt.ipAddress, tt.ethAddress, got, tt.want)
+		}
+	}
+
+	invalid := writeAccessList(t, t.TempDir(), "list", "0x0101\n")
+	if _, err := loadAccessList(invalid); err == nil {
+		t.Error("Wanted invalid entry to fail loading")
+	}
+}
+
+func Test_accessLists_watch(t *testing.T) {
+	dir := t.TempDir()
+	denylist := writeAccessList(t, dir, "denylist", "")
+	lists, err := newAccessLists("", denylist)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go lists.watch(ctx)
+
+	ethAddress := common.HexToAddress("0x0101010101010101010101010101010101010101")
+	deadline := time.Now().Add(5 * time.Second)
+	for !lists.denied("192.0.0.1", ethAddress) {
+		if time.Now().After(deadline) {
+			t.Fatal("Wanted denylist to be reloaded after it changed")
+		}
+		// Keep rewriting the file in case the watcher was not ready yet.
+		writeAccessList(t, dir, "denylist", ethAddress.Hex())
+		time.Sleep(2 * accessListReloadDelay)
+	}
+
+	// Lists which fail to load keep the previous entries.
+	writeAccessList(t, dir, "denylist", "not an entry")
+	time.Sleep(4 * accessListReloadDelay)
+	if !lists.denied("192.0.0.1", ethAddress) {
+		t.Error("Wanted previous denylist to be kept after a failed reload")
+	}
+}
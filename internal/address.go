@@ -0,0 +1,48 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/vm"
+)
+
+var precompiledAddresses = make(map[common.Address]bool)
+
+func init() {
+	for _, addr := range vm.PrecompiledAddressesBerlin {
+		precompiledAddresses[addr] = true
+	}
+}
+
+// Parses a wallet address from a funding request. Unlike common.HexToAddress,
+// it rejects anything other than a 0x-prefixed 20 byte hex string, verifies
+// the EIP-55 checksum of mixed-case addresses and refuses addresses which
+// cannot hold funds, such as the zero address and precompiles.
+func parseWalletAddress(address string) (common.Address, error) {
+	if !strings.HasPrefix(address, "0x") && !strings.HasPrefix(address, "0X") {
+		return common.Address{}, errors.New("address must start with 0x")
+	}
+	b, err := hexutil.Decode("0x" + address[2:])
+	if err != nil {
+		return common.Address{}, fmt.Errorf("address is not a hex string: %w", err)
+	}
+	if len(b) != common.AddressLength {
+		return common.Address{}, fmt.Errorf("address must be %d bytes, got %d", common.AddressLength, len(b))
+	}
+	addr := common.BytesToAddress(b)
+	digits := address[2:]
+	if digits != strings.ToLower(digits) && digits != strings.ToUpper(digits) && "0x"+digits != addr.Hex() {
+		return common.Address{}, fmt.Errorf("invalid EIP-55 checksum, wanted %s", addr.Hex())
+	}
+	if addr == (common.Address{}) {
+		return common.Address{}, errors.New("cannot fund the zero address")
+	}
+	if precompiledAddresses[addr] {
+		return common.Address{}, fmt.Errorf("cannot fund precompiled contract %s", addr.Hex())
+	}
+	return addr, nil
+}
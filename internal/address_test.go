@@ -0,0 +1,39 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+)
+
+func Test_parseWalletAddress(t *testing.T) {
+	checksummed := "0x8ba1f109551bD432803012645Ac136ddd64DBA72"
+	tests := []struct {
+		name    string
+		address string
+		wantErr bool
+	}{
+		{name: "checksummed", address: checksummed},
+		{name: "lowercase", address: strings.ToLower(checksummed)},
+		{name: "uppercase", address: "0x" + strings.ToUpper(checksummed[2:])},
+		{name: "empty", address: "", wantErr: true},
+		{name: "missing_prefix", address: checksummed[2:], wantErr: true},
+		{name: "too_short", address: checksummed[:40], wantErr: true},
+		{name: "too_long", address: checksummed + "00", wantErr: true},
+		{name: "not_hex", address: "0x8ba1f109551bD432803012645Ac136ddd64DBAzz", wantErr: true},
+		{name: "bad_checksum", address: "0x8Ba1f109551bD432803012645Ac136ddd64DBA72", wantErr: true},
+		{name: "zero_address", address: "0x0000000000000000000000000000000000000000", wantErr: true},
+		{name: "precompile", address: "0x0000000000000000000000000000000000000001", wantErr: true},
+		{name: "last_precompile", address: "0x0000000000000000000000000000000000000009", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, err := parseWalletAddress(tt.address)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseWalletAddress(%q) error = %v, wantErr %v", tt.address, err, tt.wantErr)
+			}
+			if !tt.wantErr && addr.Hex() != checksummed {
+				t.Errorf("Wanted %s, got %s", checksummed, addr.Hex())
+			}
+		})
+	}
+}
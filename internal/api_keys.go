@@ -0,0 +1,161 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	// Metadata key, and http header, clients pass their api key in.
+	apiKeyHeader = "x-api-key"
+	apiKeyQuota  = "API_KEY_QUOTA"
+)
+
+// APIKey configures a client which authenticates with an api key instead of
+// solving captchas. Only the hex encoded sha256 hash of the key is stored.
+// Keys without a quota use the default quota, and a quota of 0 disables it.
+type APIKey struct {
+	Name  string `mapstructure:"name"`
+	Hash  string `mapstructure:"hash"`
+	Quota *int   `mapstructure:"quota"`
+}
+
+var errInvalidAPIKey = errors.New("invalid api key")
+
+// Api keys let authenticated clients such as CI pipelines skip captcha
+// verification. Instead of the per-ip and per-address limits, each key may
+// fund a quota of requests within a sliding window, counted by a rate limiter
+// of its own on the backend of the faucet's rate limiter, so replicas sharing
+// a redis instance share the quota. Like the other limits, a funding request
+// reserves a use of the quota which is released if the funding fails.
+type apiKeys struct {
+	keys map[[sha256.Size]byte]*apiKey
+}
+
+type apiKey struct {
+	name        string
+	quota       int
+	rateLimiter rateLimiter
+}
+
+// Loads the api keys in the configuration and the api keys file, which lists
+// a name, the hex encoded sha256 hash of the key and optionally its quota per
+// line.
+func newAPIKeys(cfg *Config, base rateLimiter) (*apiKeys, error) {
+	configured := append([]APIKey{}, cfg.APIKeys...)
+	if cfg.APIKeysPath != "" {
+		fromFile, err := loadAPIKeysFile(cfg.APIKeysPath)
+		if err != nil {
+			return nil, fmt.Errorf("could not load api keys: %w", err)
+		}
+		configured = append(configured, fromFile...)
+	}
+	k := &apiKeys{keys: make(map[[sha256.Size]byte]*apiKey)}
+	for _, c := range configured {
+		hash, err := hex.DecodeString(strings.TrimPrefix(c.Hash, "0x"))
+		if err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("api key %q needs a hex encoded sha256 hash", c.Name)
+		}
+		var h [sha256.Size]byte
+		copy(h[:], hash)
+		if _, ok := k.keys[h]; ok {
+			return nil, fmt.Errorf("api key %q is configured twice", c.Name)
+		}
+		quota := cfg.APIKeyQuota
+		if c.Quota != nil {
+			quota = *c.Quota
+		}
+		limiter, err := newScopedRateLimiter(base, apiKeyLimits(c.Name, hex.EncodeToString(hash), quota, cfg.APIKeyWindow))
+		if err != nil {
+			return nil, fmt.Errorf("could not initialize rate limiter of api key %q: %w", c.Name, err)
+		}
+		k.keys[h] = &apiKey{name: c.Name, quota: quota, rateLimiter: limiter}
+	}
+	return k, nil
+}
+
+// Limits counting every use of an api key as a distinct member of the key
+// within the window, scoped to the hash of the key. Reservations name the use
+// in place of the ETH address, and need no cooldown.
+func apiKeyLimits(name, hash string, quota int, window time.Duration) rateLimits {
+	return rateLimits{
+		scope:  "api-key:" + hash,
+		window: window,
+		policies: []windowPolicy{{
+			reason:   apiKeyQuota,
+			describe: fmt.Sprintf("api key %%s used up its quota of %d requests", quota),
+			limit:    quota,
+			entry: func(_, use string) (string, string) {
+				return name, use
+			},
+		}},
+	}
+}
+
+// Reads the api keys listed in the file, skipping blank lines and comments.
+func loadAPIKeysFile(path string) ([]APIKey, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			log.WithError(err).Errorf("Could not close api keys file %s", path)
+		}
+	}()
+	var keys []APIKey
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		fields := strings.Fields(strings.SplitN(scanner.Text(), "#", 2)[0])
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("%s:%d: wanted a name, hash and optional quota", path, lineNum)
+		}
+		key := APIKey{Name: fields[0], Hash: fields[1]}
+		if len(fields) == 3 {
+			quota, err := strconv.Atoi(fields[2])
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: invalid quota: %w", path, lineNum, err)
+			}
+			key.Quota = &quota
+		}
+		keys = append(keys, key)
+	}
+	return keys, scanner.Err()
+}
+
+// Authenticates the api key passed in the request metadata. Returns nil if
+// the request has no api key, and errInvalidAPIKey if it is unknown.
+func (k *apiKeys) authenticate(ctx context.Context) (*apiKey, error) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok || len(md.Get(apiKeyHeader)) == 0 || md.Get(apiKeyHeader)[0] == "" {
+		return nil, nil
+	}
+	key, ok := k.keys[sha256.Sum256([]byte(md.Get(apiKeyHeader)[0]))]
+	if !ok {
+		return nil, errInvalidAPIKey
+	}
+	return key, nil
+}
+
+// Reserves a use of the quota of the api key for a request from the ip address.
+func (k *apiKeys) reserve(key *apiKey, ipAddress string) (*reservation, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, fmt.Errorf("could not generate api key use: %w", err)
+	}
+	return key.rateLimiter.reserve(ipAddress, hex.EncodeToString(b))
+}
@@ -0,0 +1,136 @@
+package internal
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+)
+
+func hashAPIKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+func withQuota(n int) *int {
+	return &n
+}
+
+func apiKeyContext(key string) context.Context {
+	return metadata.NewIncomingContext(context.Background(), metadata.Pairs(apiKeyHeader, key))
+}
+
+func Test_newAPIKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "api-keys")
+	contents := "# CI pipelines\nci " + hashAPIKey("ci-key") + " 3\nintegration " + hashAPIKey("integration-key") + "\nretired " + hashAPIKey("retired-key") + " 0\n"
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &Config{
+		APIKeys: []APIKey{
+			{Name: "staging", Hash: hashAPIKey("staging-key"), Quota: withQuota(7)},
+			{Name: "unlimited", Hash: hashAPIKey("unlimited-key"), Quota: withQuota(0)},
+		},
+		APIKeysPath:  path,
+		APIKeyQuota:  10,
+		APIKeyWindow: time.Hour,
+	}
+	k, err := newAPIKeys(cfg, newSimpleRateLimiter(newRateLimits(cfg)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, wantQuota := range map[string]int{"ci-key": 3, "integration-key": 10, "staging-key": 7, "unlimited-key": 0, "retired-key": 0} {
+		got, err := k.authenticate(apiKeyContext(key))
+		if err != nil || got == nil {
+			t.Fatalf("Wanted %s to authenticate, got %v", key, err)
+		}
+		if got.quota != wantQuota {
+			t.Errorf("Wanted quota %d for %s, got %d", wantQuota, key, got.quota)
+		}
+	}
+	if _, err := k.authenticate(apiKeyContext("unknown-key")); err != errInvalidAPIKey {
+		t.Errorf("Wanted unknown key to be invalid, got %v", err)
+	}
+	if key, err := k.authenticate(context.Background()); key != nil || err != nil {
+		t.Errorf("Wanted no key without metadata, got %v, %v", key, err)
+	}
+
+	cfg = &Config{APIKeys: []APIKey{{Name: "plaintext", Hash: "ci-key"}}}
+	if _, err := newAPIKeys(cfg, newSimpleRateLimiter(newRateLimits(cfg))); err == nil {
+		t.Error("Wanted key without a sha256 hash to fail")
+	}
+}
+
+func Test_apiKeys_reserve(t *testing.T) {
+	for _, backend := range rateLimiterBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			cfg := &Config{
+				APIKeys: []APIKey{
+					{Name: "ci", Hash: hashAPIKey("ci-key"), Quota: withQuota(2)},
+					{Name: "unlimited", Hash: hashAPIKey("unlimited-key"), Quota: withQuota(0)},
+				},
+				APIKeyWindow: 200 * time.Millisecond,
+			}
+			base := backend.new(t, testRateLimits(3, 3, time.Hour))
+			// Api keys sharing a bolt or redis backend within one process share
+			// the quota of each key, while the memory rate limiters of scoped
+			// limits are kept apart.
+			stores := make([]*apiKeys, 2)
+			for i := range stores {
+				k, err := newAPIKeys(cfg, base)
+				if err != nil {
+					t.Fatal(err)
+				}
+				stores[i] = k
+			}
+			if backend.name == memoryRateLimiterBackend {
+				stores[1] = stores[0]
+			}
+			key := func(k *apiKeys, name string) *apiKey {
+				got, err := k.authenticate(apiKeyContext(name))
+				if err != nil {
+					t.Fatal(err)
+				}
+				return got
+			}
+
+			// Redis keeps the time of each use to the millisecond.
+			start := time.Now().Truncate(time.Millisecond)
+			first, err := stores[0].reserve(key(stores[0], "ci-key"), "192.0.0.1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := stores[1].reserve(key(stores[1], "ci-key"), "192.0.0.1"); err != nil {
+				t.Fatal(err)
+			}
+			limitErr := requireLimit(t, func() error {
+				_, err := stores[1].reserve(key(stores[1], "ci-key"), "192.0.0.1")
+				return err
+			}(), apiKeyQuota)
+			if limitErr.resetAt.Before(start.Add(cfg.APIKeyWindow)) || limitErr.resetAt.After(time.Now().Add(cfg.APIKeyWindow)) {
+				t.Errorf("Wanted quota to reset a window after the first use, got %v", limitErr.resetAt)
+			}
+			for i := 0; i < 5; i++ {
+				if _, err := stores[i%2].reserve(key(stores[i%2], "unlimited-key"), "192.0.0.1"); err != nil {
+					t.Errorf("Wanted a quota of 0 to be disabled, got %v", err)
+				}
+			}
+
+			// Released uses and uses which left the window no longer count.
+			ci := key(stores[0], "ci-key")
+			ci.rateLimiter.release(first)
+			if _, err := stores[0].reserve(ci, "192.0.0.1"); err != nil {
+				t.Errorf("Wanted released use to free the quota, got %v", err)
+			}
+			time.Sleep(cfg.APIKeyWindow)
+			if _, err := stores[0].reserve(ci, "192.0.0.1"); err != nil {
+				t.Errorf("Wanted quota to reset after the window, got %v", err)
+			}
+		})
+	}
+}
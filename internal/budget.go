@@ -0,0 +1,148 @@
+package internal
+
+import (
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const faucetPaused = "FAUCET_PAUSED"
+
+// Spending budget caps the wei sent by the faucet within a rolling window and
+// the number of transactions it sends per minute. Once either is exhausted the
+// budget trips, pausing the faucet until enough of the earliest spends leave
+// the exhausted window to make room for the request, or an operator resumes it.
+// The budget is kept in memory, so every replica of the faucet has a budget of
+// its own.
+type spendingBudget struct {
+	mutex          sync.Mutex
+	maxWei         *big.Int
+	window         time.Duration
+	maxTxPerMinute int
+	spends         []*spend
+	pausedUntil    time.Time
+}
+
+// Wei sent by a funding request, counted against the budget from the moment
+// it was reserved.
+type spend struct {
+	amount *big.Int
+	at     time.Time
+}
+
+// Returned while the spending budget is exhausted.
+type budgetExhaustedError struct {
+	pausedUntil time.Time
+}
+
+func (e *budgetExhaustedError) Error() string {
+	return fmt.Sprintf("faucet is paused until %s", e.pausedUntil.UTC().Format(time.RFC3339))
+}
+
+// Converts the error into a gRPC status explaining the pause.
+func (e *budgetExhaustedError) grpcStatus() *status.Status {
+	return deniedStatus(codes.ResourceExhausted, fmt.Sprintf("Faucet spending budget exhausted: %v", e), faucetPaused, e.pausedUntil)
+}
+
+// Initializes a spending budget. A nil or zero max wei, or a zero max number of
+// transactions per minute, disables the respective limit.
+func newSpendingBudget(maxWei *big.Int, window time.Duration, maxTxPerMinute int) *spendingBudget {
+	return &spendingBudget{
+		maxWei:         maxWei,
+		window:         window,
+		maxTxPerMinute: maxTxPerMinute,
+	}
+}
+
+// Reserves the amount from the budget, tripping the budget if it would be exceeded.
+func (b *spendingBudget) reserve(amount *big.Int) (*spend, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	now := time.Now()
+	if now.Before(b.pausedUntil) {
+		return nil, &budgetExhaustedError{pausedUntil: b.pausedUntil}
+	}
+	b.pruneSpends(now)
+
+	// Spends are kept in the order they were made, so the faucet can resume
+	// once enough of the oldest ones leave their window to make room.
+	var inWindow, inLastMinute []*spend
+	spent := new(big.Int)
+	for _, s := range b.spends {
+		if now.Sub(s.at) < b.window {
+			inWindow = append(inWindow, s)
+			spent.Add(spent, s.amount)
+		}
+		if now.Sub(s.at) < time.Minute {
+			inLastMinute = append(inLastMinute, s)
+		}
+	}
+	if b.maxWei != nil && b.maxWei.Sign() > 0 && spent.Add(spent, amount).Cmp(b.maxWei) > 0 {
+		pausedUntil := now.Add(b.window)
+		for _, s := range inWindow {
+			spent.Sub(spent, s.amount)
+			if spent.Cmp(b.maxWei) <= 0 {
+				pausedUntil = s.at.Add(b.window)
+				break
+			}
+		}
+		return nil, b.trip(pausedUntil, "Spending budget exhausted")
+	}
+	if b.maxTxPerMinute > 0 && len(inLastMinute) >= b.maxTxPerMinute {
+		pausedUntil := inLastMinute[len(inLastMinute)-b.maxTxPerMinute].at.Add(time.Minute)
+		return nil, b.trip(pausedUntil, "Transactions per minute exhausted")
+	}
+	s := &spend{amount: amount, at: now}
+	b.spends = append(b.spends, s)
+	return s, nil
+}
+
+// Returns the amount of a funding request which failed to the budget.
+func (b *spendingBudget) release(s *spend) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for i, other := range b.spends {
+		if other == s {
+			b.spends = append(b.spends[:i], b.spends[i+1:]...)
+			return
+		}
+	}
+}
+
+// Resumes a paused faucet, starting with a fresh budget.
+func (b *spendingBudget) resume() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.pausedUntil = time.Time{}
+	b.spends = nil
+	log.Info("Faucet resumed by operator")
+}
+
+// Pauses the faucet until the given time. Requires the lock.
+func (b *spendingBudget) trip(pausedUntil time.Time, msg string) error {
+	b.pausedUntil = pausedUntil
+	log.WithFields(logrus.Fields{
+		"pausedUntil": pausedUntil.UTC().Format(time.RFC3339),
+	}).Warn(msg + ", pausing faucet")
+	return &budgetExhaustedError{pausedUntil: pausedUntil}
+}
+
+// Drops spends which no longer count against any limit. Requires the lock.
+func (b *spendingBudget) pruneSpends(now time.Time) {
+	keep := b.window
+	if keep < time.Minute {
+		keep = time.Minute
+	}
+	pruned := b.spends[:0]
+	for _, s := range b.spends {
+		if now.Sub(s.at) < keep {
+			pruned = append(pruned, s)
+		}
+	}
+	b.spends = pruned
+}
@@ -0,0 +1,105 @@
+package internal
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func Test_spendingBudget(t *testing.T) {
+	amount := big.NewInt(10)
+
+	t.Run("exhausted_budget_trips", func(t *testing.T) {
+		b := newSpendingBudget(big.NewInt(25), time.Hour, 0)
+		for i := 0; i < 2; i++ {
+			if _, err := b.reserve(amount); err != nil {
+				t.Fatal(err)
+			}
+		}
+		_, err := b.reserve(amount)
+		var exhaustedErr *budgetExhaustedError
+		if !errors.As(err, &exhaustedErr) {
+			t.Fatalf("Wanted the budget to be exhausted, got %v", err)
+		}
+		if d := time.Until(exhaustedErr.pausedUntil); d < 59*time.Minute || d > time.Hour {
+			t.Errorf("Wanted the faucet to be paused for the budget window, got %v", d)
+		}
+		if _, err := b.reserve(big.NewInt(1)); err == nil {
+			t.Error("Should stay paused even for amounts within the budget")
+		}
+	})
+
+	t.Run("pauses_until_spends_make_room", func(t *testing.T) {
+		b := newSpendingBudget(big.NewInt(25), time.Hour, 0)
+		for i := 0; i < 2; i++ {
+			if _, err := b.reserve(amount); err != nil {
+				t.Fatal(err)
+			}
+		}
+		b.spends[0].at = b.spends[0].at.Add(-50 * time.Minute)
+		_, err := b.reserve(amount)
+		var exhaustedErr *budgetExhaustedError
+		if !errors.As(err, &exhaustedErr) {
+			t.Fatalf("Wanted the budget to be exhausted, got %v", err)
+		}
+		if d := time.Until(exhaustedErr.pausedUntil); d < 9*time.Minute || d > 10*time.Minute {
+			t.Errorf("Wanted the faucet to be paused until the earliest spend leaves the window, got %v", d)
+		}
+	})
+
+	t.Run("released_spend_returns_to_budget", func(t *testing.T) {
+		b := newSpendingBudget(big.NewInt(15), time.Hour, 0)
+		s, err := b.reserve(amount)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.release(s)
+		if _, err := b.reserve(amount); err != nil {
+			t.Errorf("Should allow after the spend was released: %v", err)
+		}
+	})
+
+	t.Run("spends_leave_window", func(t *testing.T) {
+		b := newSpendingBudget(big.NewInt(15), time.Hour, 0)
+		s, err := b.reserve(amount)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.at = s.at.Add(-time.Hour)
+		if _, err := b.reserve(amount); err != nil {
+			t.Errorf("Should allow once earlier spends left the window: %v", err)
+		}
+	})
+
+	t.Run("max_tx_per_minute_trips", func(t *testing.T) {
+		b := newSpendingBudget(nil, time.Hour, 2)
+		for i := 0; i < 2; i++ {
+			if _, err := b.reserve(amount); err != nil {
+				t.Fatal(err)
+			}
+		}
+		_, err := b.reserve(amount)
+		var exhaustedErr *budgetExhaustedError
+		if !errors.As(err, &exhaustedErr) {
+			t.Fatalf("Wanted the transactions per minute to be exhausted, got %v", err)
+		}
+		if d := time.Until(exhaustedErr.pausedUntil); d > time.Minute {
+			t.Errorf("Wanted the faucet to be paused for a minute, got %v", d)
+		}
+	})
+
+	t.Run("resume_clears_pause", func(t *testing.T) {
+		b := newSpendingBudget(big.NewInt(15), time.Hour, 0)
+		if _, err := b.reserve(amount); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.reserve(amount); err == nil {
+			t.Fatal("Wanted the budget to be exhausted")
+		}
+		b.resume()
+		if _, err := b.reserve(amount); err != nil {
+			t.Errorf("Should allow after an operator resumed the faucet: %v", err)
+		}
+	})
+}
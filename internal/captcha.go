@@ -0,0 +1,293 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	faucetpb "github.com/rauljordan/eth-faucet/proto/faucet"
+)
+
+const (
+	recaptchaV3Provider = "recaptcha-v3"
+	recaptchaV2Provider = "recaptcha-v2"
+	hcaptchaProvider    = "hcaptcha"
+	turnstileProvider   = "turnstile"
+
+	maxCaptchaChallengeAge = 2 * time.Minute
+	captchaVerifyTimeout   = 10 * time.Second
+)
+
+var (
+	// Returned when the captcha provider or the used token store could not be
+	// reached, which does not count as a failed captcha.
+	errCaptchaUnavailable = errors.New("could not check captcha response")
+	// Returned when no captcha site is configured for the origin of a request,
+	// which is a configuration error rather than a failed captcha.
+	errNoCaptchaSite = errors.New("no captcha site configured")
+)
+
+// Captcha verifiers check a captcha response solved by the user requesting
+// funds for a wallet address with the captcha provider.
+type captchaVerifier interface {
+	verify(ctx context.Context, remoteIP, origin, response string, walletAddress common.Address) error
+	// Longest time after solving a captcha its response is accepted.
+	maxChallengeAge() time.Duration
+}
+
+// Describes the siteverify endpoint of a captcha provider and which of the
+// optional fields of its verification response the faucet checks.
+type captchaProvider struct {
+	verifyURL string
+	// Whether the provider scores how likely the user is human.
+	scored bool
+	// Whether the provider echoes the action the captcha was solved for,
+	// which the faucet clients set to the wallet address.
+	bindsAction bool
+}
+
+var captchaProviders = map[string]captchaProvider{
+	recaptchaV3Provider: {
+		verifyURL:   "https://www.google.com/recaptcha/api/siteverify",
+		scored:      true,
+		bindsAction: true,
+	},
+	recaptchaV2Provider: {
+		verifyURL: "https://www.google.com/recaptcha/api/siteverify",
+	},
+	hcaptchaProvider: {
+		verifyURL: "https://hcaptcha.com/siteverify",
+	},
+	turnstileProvider: {
+		verifyURL: "https://challenges.cloudflare.com/turnstile/v0/siteverify",
+	},
+}
+
+// Response of a siteverify endpoint. Every supported provider shares this
+// format, although only some of them fill in the score and action.
+type siteverifyResponse struct {
+	Success     bool      `json:"success"`
+	Score       float64   `json:"score"`
+	Action      string    `json:"action"`
+	ChallengeTS time.Time `json:"challenge_ts"`
+	Hostname    string    `json:"hostname"`
+	ErrorCodes  []string  `json:"error-codes"`
+}
+
+// Verifies captcha responses with the siteverify endpoint of a provider,
+// using the secret and requirements of the frontend site the request was
+// made from.
+type siteverifyVerifier struct {
+	provider  captchaProvider
+	verifyURL string
+	sites     []CaptchaSite
+	client    *http.Client
+}
+
+// CaptchaSite configures the captcha of a frontend site served from a hostname
+// with its own captcha site key. Sites without a min score use the default min
+// score, and a min score of 0 accepts every score.
+type CaptchaSite struct {
+	Hostname        string        `mapstructure:"hostname"`
+	Secret          string        `mapstructure:"secret"`
+	MinScore        *float64      `mapstructure:"min-score"`
+	MaxChallengeAge time.Duration `mapstructure:"max-challenge-age"`
+}
+
+// Verifies the request solved either a proof-of-work challenge or a captcha.
+// Each challenge and captcha token is claimed before it is verified, and
+// released again only if verification failed, so it can fund a single request.
+func (s *Server) verifyChallenge(
+	ctx context.Context, ipAddress string, walletAddress common.Address, req *faucetpb.FundingRequest,
+) error {
+	now := time.Now()
+	if req.PowChallenge != "" {
+		if s.pow == nil {
+			return errors.New("proof-of-work challenges are disabled")
+		}
+		return s.verifyOnce(req.PowChallenge, now.Add(s.pow.ttl), func() error {
+			return s.pow.verify(req.PowChallenge, req.PowNonce, walletAddress, now)
+		})
+	}
+	if s.captcha == nil {
+		return errors.New("missing proof-of-work challenge")
+	}
+	if req.CaptchaResponse == "" {
+		return errors.New("missing captcha response")
+	}
+	return s.verifyOnce(req.CaptchaResponse, now.Add(s.captcha.maxChallengeAge()), func() error {
+		return s.captcha.verify(ctx, ipAddress, getOrigin(ctx), req.CaptchaResponse, walletAddress)
+	})
+}
+
+func (s *Server) verifyOnce(token string, expiresAt time.Time, verify func() error) error {
+	if err := s.usedTokens.claim(token, expiresAt, time.Now()); err != nil {
+		if errors.Is(err, errTokenUsed) {
+			return err
+		}
+		return fmt.Errorf("%w: %v", errCaptchaUnavailable, err)
+	}
+	if err := verify(); err != nil {
+		s.usedTokens.release(token)
+		return err
+	}
+	return nil
+}
+
+// Initializes the captcha verifier for the provider selected in the server
+// configuration.
+func newCaptchaVerifier(cfg *Config) (captchaVerifier, error) {
+	name := cfg.CaptchaProvider
+	if name == "" {
+		name = recaptchaV3Provider
+	}
+	provider, ok := captchaProviders[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown captcha provider %q", cfg.CaptchaProvider)
+	}
+	verifyURL := provider.verifyURL
+	if cfg.CaptchaVerifyURL != "" {
+		verifyURL = cfg.CaptchaVerifyURL
+	}
+	// The captcha host and secret flags configure a site of their own.
+	defaultMinScore := cfg.CaptchaMinScore
+	sites := make([]CaptchaSite, 0, len(cfg.CaptchaSites)+1)
+	if cfg.CaptchaSecret != "" || len(cfg.CaptchaSites) == 0 {
+		sites = append(sites, CaptchaSite{
+			Hostname: cfg.CaptchaHost,
+			Secret:   cfg.CaptchaSecret,
+			MinScore: &defaultMinScore,
+		})
+	}
+	for _, site := range cfg.CaptchaSites {
+		if site.Secret == "" {
+			return nil, fmt.Errorf("captcha site %q needs a secret", site.Hostname)
+		}
+		if site.MinScore == nil {
+			site.MinScore = &defaultMinScore
+		}
+		sites = append(sites, site)
+	}
+	for i := range sites {
+		if sites[i].MaxChallengeAge <= 0 {
+			sites[i].MaxChallengeAge = maxCaptchaChallengeAge
+		}
+	}
+	return &siteverifyVerifier{
+		provider:  provider,
+		verifyURL: verifyURL,
+		sites:     sites,
+		client:    &http.Client{Timeout: captchaVerifyTimeout},
+	}, nil
+}
+
+func (v *siteverifyVerifier) maxChallengeAge() time.Duration {
+	maxAge := time.Duration(0)
+	for _, site := range v.sites {
+		if site.MaxChallengeAge > maxAge {
+			maxAge = site.MaxChallengeAge
+		}
+	}
+	return maxAge
+}
+
+// Picks the site whose hostname most specifically matches the origin of the
+// request. Requests without a matching origin, such as those of gRPC clients,
+// can only be verified if there is a single site.
+func (v *siteverifyVerifier) site(origin string) (*CaptchaSite, error) {
+	host := origin
+	if u, err := url.Parse(origin); err == nil && u.Hostname() != "" {
+		host = u.Hostname()
+	}
+	var match *CaptchaSite
+	for i, site := range v.sites {
+		if !onHostname(host, site.Hostname) {
+			continue
+		}
+		if match == nil || len(site.Hostname) > len(match.Hostname) {
+			match = &v.sites[i]
+		}
+	}
+	if match != nil {
+		return match, nil
+	}
+	if len(v.sites) == 1 {
+		return &v.sites[0], nil
+	}
+	return nil, fmt.Errorf("%w for origin %q", errNoCaptchaSite, origin)
+}
+
+// Whether the host is the hostname or one of its subdomains.
+func onHostname(host, hostname string) bool {
+	return host == hostname || strings.HasSuffix(host, "."+hostname)
+}
+
+func (v *siteverifyVerifier) verify(
+	ctx context.Context, remoteIP, origin, response string, walletAddress common.Address,
+) error {
+	if response == "" {
+		return errors.New("missing captcha response")
+	}
+	site, err := v.site(origin)
+	if err != nil {
+		return err
+	}
+	rr, err := v.siteverify(ctx, site.Secret, remoteIP, response)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errCaptchaUnavailable, err)
+	}
+	if !rr.Success {
+		return fmt.Errorf("unsuccessful captcha request, error codes: %+v", rr.ErrorCodes)
+	}
+	if v.provider.scored && rr.Score < *site.MinScore {
+		return fmt.Errorf("captcha score too low (%f)", rr.Score)
+	}
+	if time.Now().After(rr.ChallengeTS.Add(site.MaxChallengeAge)) {
+		return errors.New("captcha challenge too old")
+	}
+	// Captcha actions may not preserve the casing of the address, so compare
+	// the addresses themselves.
+	if v.provider.bindsAction && (!common.IsHexAddress(rr.Action) || common.HexToAddress(rr.Action) != walletAddress) {
+		return fmt.Errorf("action was %s, wanted %s", rr.Action, walletAddress.Hex())
+	}
+	if site.Hostname != "" && !onHostname(rr.Hostname, site.Hostname) {
+		return fmt.Errorf("expected hostname (%s) to be %s or one of its subdomains", rr.Hostname, site.Hostname)
+	}
+	return nil
+}
+
+func (v *siteverifyVerifier) siteverify(ctx context.Context, secret, remoteIP, response string) (*siteverifyResponse, error) {
+	form := url.Values{
+		"secret":   {secret},
+		"response": {response},
+		"remoteip": {remoteIP},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, v.verifyURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.WithError(err).Error("Could not close captcha verification response")
+		}
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("siteverify returned status %d", resp.StatusCode)
+	}
+	rr := &siteverifyResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(rr); err != nil {
+		return nil, fmt.Errorf("could not decode siteverify response: %w", err)
+	}
+	return rr, nil
+}
@@ -0,0 +1,186 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	captchaBanned = "CAPTCHA_BANNED"
+
+	ipOffender      = "ip"
+	addressOffender = "address"
+)
+
+// Captcha penalties count the failed captchas of every ip and address, and
+// ban them temporarily once they fail too many times so that their requests
+// are rejected before calling the captcha provider. Every ban is twice as long
+// as the previous one, up to a max duration, and offenders are forgiven once
+// they behaved for a whole failure window.
+type captchaPenalties struct {
+	mutex          sync.Mutex
+	thresholds     map[string]int
+	window         time.Duration
+	banDuration    time.Duration
+	maxBanDuration time.Duration
+	offenders      map[string]*offender
+	pruneInterval  time.Duration
+}
+
+type offender struct {
+	failures    int
+	lastFailure time.Time
+	bans        int
+	bannedUntil time.Time
+}
+
+// Returned when an ip or address is banned after repeated captcha failures.
+type captchaBanError struct {
+	kind        string
+	key         string
+	bannedUntil time.Time
+}
+
+func (e *captchaBanError) Error() string {
+	return fmt.Sprintf(
+		"%s %s banned after repeated captcha failures until %s",
+		e.kind, e.key, e.bannedUntil.UTC().Format(time.RFC3339),
+	)
+}
+
+// Converts the error into a gRPC status explaining the ban.
+func (e *captchaBanError) grpcStatus() *status.Status {
+	return deniedStatus(codes.PermissionDenied, fmt.Sprintf("Too many failed captchas: %v", e), captchaBanned, e.bannedUntil)
+}
+
+func newCaptchaPenalties(cfg *Config) *captchaPenalties {
+	return &captchaPenalties{
+		thresholds: map[string]int{
+			ipOffender:      cfg.CaptchaFailuresPerIP,
+			addressOffender: cfg.CaptchaFailuresPerAddress,
+		},
+		window:         cfg.CaptchaFailureWindow,
+		banDuration:    cfg.CaptchaBanDuration,
+		maxBanDuration: cfg.CaptchaMaxBanDuration,
+		offenders:      make(map[string]*offender),
+		pruneInterval:  10 * time.Minute, /* Forget offenders who behaved every 10 minutes */
+	}
+}
+
+// Returns the ban of the ip or address, if either of them is banned.
+func (p *captchaPenalties) check(ipAddress string, walletAddress common.Address, now time.Time) *captchaBanError {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, key := range penaltyKeys(ipAddress, walletAddress) {
+		if o, ok := p.offenders[key.kind+":"+key.key]; ok && now.Before(o.bannedUntil) {
+			return &captchaBanError{kind: key.kind, key: key.key, bannedUntil: o.bannedUntil}
+		}
+	}
+	return nil
+}
+
+// Counts a failed captcha against the ip and address, banning those which
+// reached their threshold.
+func (p *captchaPenalties) recordFailure(ipAddress string, walletAddress common.Address, now time.Time) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, key := range penaltyKeys(ipAddress, walletAddress) {
+		threshold := p.thresholds[key.kind]
+		if threshold <= 0 {
+			continue
+		}
+		k := key.kind + ":" + key.key
+		o, ok := p.offenders[k]
+		if !ok || p.forgiven(o, now) {
+			o = &offender{}
+			p.offenders[k] = o
+		}
+		o.failures++
+		o.lastFailure = now
+		if o.failures < threshold {
+			continue
+		}
+		banDuration := p.banDuration
+		for i := 0; i < o.bans && banDuration < p.maxBanDuration; i++ {
+			banDuration *= 2
+		}
+		if banDuration > p.maxBanDuration {
+			banDuration = p.maxBanDuration
+		}
+		o.failures = 0
+		o.bans++
+		o.bannedUntil = now.Add(banDuration)
+		captchaBansTotal.WithLabelValues(key.kind).Inc()
+		log.WithFields(logrus.Fields{
+			key.kind:      key.key,
+			"bans":        o.bans,
+			"bannedUntil": o.bannedUntil.UTC().Format(time.RFC3339),
+		}).Warn("Banned client after repeated captcha failures")
+	}
+}
+
+// Clears the failures counted against the ip and address, keeping their bans
+// escalating until they are forgiven.
+func (p *captchaPenalties) recordSuccess(ipAddress string, walletAddress common.Address) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, key := range penaltyKeys(ipAddress, walletAddress) {
+		if o, ok := p.offenders[key.kind+":"+key.key]; ok {
+			o.failures = 0
+		}
+	}
+}
+
+// Forget offenders who behaved for a whole failure window every so often.
+func (p *captchaPenalties) refresh(ctx context.Context) {
+	ticker := time.NewTicker(p.pruneInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			p.mutex.Lock()
+			p.pruneExpired(now)
+			p.mutex.Unlock()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Requires the lock.
+func (p *captchaPenalties) pruneExpired(now time.Time) {
+	for k, o := range p.offenders {
+		if p.forgiven(o, now) {
+			delete(p.offenders, k)
+		}
+	}
+}
+
+// Whether an offender behaved for a whole failure window since its last
+// failure or ban.
+func (p *captchaPenalties) forgiven(o *offender, now time.Time) bool {
+	lastOffense := o.lastFailure
+	if o.bannedUntil.After(lastOffense) {
+		lastOffense = o.bannedUntil
+	}
+	return !now.Before(lastOffense.Add(p.window))
+}
+
+type penaltyKey struct {
+	kind string
+	key  string
+}
+
+func penaltyKeys(ipAddress string, walletAddress common.Address) []penaltyKey {
+	return []penaltyKey{
+		{kind: ipOffender, key: ipAddress},
+		{kind: addressOffender, key: walletAddress.Hex()},
+	}
+}
@@ -0,0 +1,76 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func Test_captchaPenalties(t *testing.T) {
+	p := newCaptchaPenalties(&Config{
+		CaptchaFailuresPerIP:      2,
+		CaptchaFailuresPerAddress: 0,
+		CaptchaFailureWindow:      time.Hour,
+		CaptchaBanDuration:        time.Minute,
+		CaptchaMaxBanDuration:     3 * time.Minute,
+	})
+	ipAddress := "192.0.0.1"
+	walletAddress := common.HexToAddress("0x0101010101010101010101010101010101010101")
+	now := time.Now()
+
+	// Bans double in length up to the max ban duration.
+	for i, wantBan := range []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute, 3 * time.Minute} {
+		p.recordFailure(ipAddress, walletAddress, now)
+		if err := p.check(ipAddress, walletAddress, now); err != nil {
+			t.Fatalf("Wanted no ban below the threshold, got %v", err)
+		}
+		p.recordFailure(ipAddress, walletAddress, now)
+		err := p.check(ipAddress, walletAddress, now)
+		if err == nil {
+			t.Fatalf("Wanted ban %d after reaching the threshold", i)
+		}
+		if err.kind != ipOffender {
+			t.Errorf("Wanted ip to be banned, got %s", err.kind)
+		}
+		if got := err.bannedUntil.Sub(now); got != wantBan {
+			t.Errorf("Wanted ban %d to last %v, got %v", i, wantBan, got)
+		}
+		now = err.bannedUntil
+		if err := p.check(ipAddress, walletAddress, now); err != nil {
+			t.Errorf("Wanted ban to end, got %v", err)
+		}
+	}
+
+	// Offenders behaving for a whole window are forgiven.
+	p.pruneExpired(now.Add(time.Hour))
+	if len(p.offenders) != 0 {
+		t.Errorf("Wanted offenders to be forgiven, got %d", len(p.offenders))
+	}
+	p.recordFailure(ipAddress, walletAddress, now.Add(time.Hour))
+	p.recordFailure(ipAddress, walletAddress, now.Add(time.Hour))
+	if err := p.check(ipAddress, walletAddress, now.Add(time.Hour)); err == nil || err.bannedUntil.Sub(now.Add(time.Hour)) != time.Minute {
+		t.Errorf("Wanted forgiven offender to start over with a short ban, got %v", err)
+	}
+}
+
+func Test_captchaPenalties_successClearsFailures(t *testing.T) {
+	p := newCaptchaPenalties(&Config{
+		CaptchaFailuresPerAddress: 2,
+		CaptchaFailureWindow:      time.Hour,
+		CaptchaBanDuration:        time.Minute,
+		CaptchaMaxBanDuration:     time.Hour,
+	})
+	walletAddress := common.HexToAddress("0x0101010101010101010101010101010101010101")
+	now := time.Now()
+	p.recordFailure("192.0.0.1", walletAddress, now)
+	p.recordSuccess("192.0.0.1", walletAddress)
+	p.recordFailure("192.0.0.2", walletAddress, now)
+	if err := p.check("192.0.0.3", walletAddress, now); err != nil {
+		t.Errorf("Wanted failures to be cleared by a solved captcha, got %v", err)
+	}
+	p.recordFailure("192.0.0.2", walletAddress, now)
+	if err := p.check("192.0.0.3", walletAddress, now); err == nil || err.kind != addressOffender {
+		t.Errorf("Wanted address to be banned, got %v", err)
+	}
+}
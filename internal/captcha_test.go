@@ -0,0 +1,260 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Serves a local stand-in of a provider's siteverify endpoint, answering
+// requests with the secret and response token with the given fields.
+func newSiteverifyStandIn(t *testing.T, secret, token string, fields map[string]interface{}) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp := fields
+		if r.PostForm.Get("secret") != secret || r.PostForm.Get("response") != token || r.PostForm.Get("remoteip") == "" {
+			resp = map[string]interface{}{"success": false, "error-codes": []string{"invalid-input-response"}}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			t.Error(err)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func Test_siteverifyVerifier(t *testing.T) {
+	walletAddress := common.HexToAddress("0x8ba1f109551bD432803012645Ac136ddd64DBA72")
+	now := time.Now().UTC().Format(time.RFC3339)
+	old := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+	tests := []struct {
+		name     string
+		provider string
+		fields   map[string]interface{}
+		token    string
+		wantErr  bool
+	}{
+		{
+			name:     "recaptcha_v3_passes",
+			provider: recaptchaV3Provider,
+			fields: map[string]interface{}{
+				"success": true, "score": 0.95, "action": "0x8ba1f109551bd432803012645ac136ddd64dba72",
+				"challenge_ts": now, "hostname": "faucet.example.com",
+			},
+		},
+		{
+			name:     "recaptcha_v3_low_score",
+			provider: recaptchaV3Provider,
+			fields: map[string]interface{}{
+				"success": true, "score": 0.3, "action": walletAddress.Hex(),
+				"challenge_ts": now, "hostname": "faucet.example.com",
+			},
+			wantErr: true,
+		},
+		{
+			name:     "recaptcha_v3_other_address",
+			provider: recaptchaV3Provider,
+			fields: map[string]interface{}{
+				"success": true, "score": 0.95, "action": "0x0101010101010101010101010101010101010101",
+				"challenge_ts": now, "hostname": "faucet.example.com",
+			},
+			wantErr: true,
+		},
+		{
+			name:     "recaptcha_v2_passes_without_score",
+			provider: recaptchaV2Provider,
+			fields: map[string]interface{}{
+				"success": true, "challenge_ts": now, "hostname": "faucet.example.com",
+			},
+		},
+		{
+			name:     "recaptcha_v2_wrong_hostname",
+			provider: recaptchaV2Provider,
+			fields: map[string]interface{}{
+				"success": true, "challenge_ts": now, "hostname": "phishing.test",
+			},
+			wantErr: true,
+		},
+		{
+			name:     "hcaptcha_passes",
+			provider: hcaptchaProvider,
+			fields: map[string]interface{}{
+				"success": true, "challenge_ts": now, "hostname": "faucet.example.com", "credit": false,
+			},
+		},
+		{
+			name:     "hcaptcha_challenge_too_old",
+			provider: hcaptchaProvider,
+			fields: map[string]interface{}{
+				"success": true, "challenge_ts": old, "hostname": "faucet.example.com",
+			},
+			wantErr: true,
+		},
+		{
+			name:     "hcaptcha_lookalike_hostname",
+			provider: hcaptchaProvider,
+			fields: map[string]interface{}{
+				"success": true, "challenge_ts": now, "hostname": "evilexample.com",
+			},
+			wantErr: true,
+		},
+		{
+			name:     "turnstile_passes",
+			provider: turnstileProvider,
+			fields: map[string]interface{}{
+				"success": true, "challenge_ts": now, "hostname": "faucet.example.com", "action": "faucet", "cdata": "",
+			},
+		},
+		{
+			name:     "turnstile_unsuccessful",
+			provider: turnstileProvider,
+			fields: map[string]interface{}{
+				"success": false, "error-codes": []string{"timeout-or-duplicate"},
+			},
+			wantErr: true,
+		},
+		{
+			name:     "invalid_token",
+			provider: turnstileProvider,
+			fields: map[string]interface{}{
+				"success": true, "challenge_ts": now, "hostname": "faucet.example.com",
+			},
+			token:   "forged",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newSiteverifyStandIn(t, "secret", "token", tt.fields)
+			v, err := newCaptchaVerifier(&Config{
+				CaptchaProvider:  tt.provider,
+				CaptchaVerifyURL: srv.URL,
+				CaptchaHost:      "example.com",
+				CaptchaSecret:    "secret",
+				CaptchaMinScore:  0.9,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			token := tt.token
+			if token == "" {
+				token = "token"
+			}
+			err = v.verify(context.Background(), "192.0.0.1", "", token, walletAddress)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("verify() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_siteverifyVerifier_unavailable(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	v, err := newCaptchaVerifier(&Config{CaptchaProvider: hcaptchaProvider, CaptchaVerifyURL: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := v.verify(context.Background(), "192.0.0.1", "", "token", common.Address{}); err == nil {
+		t.Error("Wanted verification to fail when the provider is unavailable")
+	}
+}
+
+func Test_newCaptchaVerifier_unknownProvider(t *testing.T) {
+	if _, err := newCaptchaVerifier(&Config{CaptchaProvider: "friendlycaptcha"}); err == nil {
+		t.Error("Wanted unknown captcha provider to fail")
+	}
+}
+
+func withMinScore(score float64) *float64 {
+	return &score
+}
+
+func Test_siteverifyVerifier_sites(t *testing.T) {
+	walletAddress := common.HexToAddress("0x8ba1f109551bD432803012645Ac136ddd64DBA72")
+	now := time.Now()
+	// Each site has its own secret, which the stand-in answers with the
+	// fields of that site.
+	responses := map[string]map[string]interface{}{
+		"angular-secret": {
+			"success": true, "score": 0.6, "action": walletAddress.Hex(),
+			"challenge_ts": now.Add(-3 * time.Minute).UTC().Format(time.RFC3339), "hostname": "ng.faucet.example.com",
+		},
+		"react-secret": {
+			"success": true, "score": 0.6, "action": walletAddress.Hex(),
+			"challenge_ts": now.UTC().Format(time.RFC3339), "hostname": "react.example.org",
+		},
+		"vue-secret": {
+			"success": true, "score": 0.1, "action": walletAddress.Hex(),
+			"challenge_ts": now.UTC().Format(time.RFC3339), "hostname": "vue.example.net",
+		},
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp, ok := responses[r.PostForm.Get("secret")]
+		if !ok {
+			resp = map[string]interface{}{"success": false, "error-codes": []string{"invalid-input-secret"}}
+		}
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer srv.Close()
+
+	v, err := newCaptchaVerifier(&Config{
+		CaptchaVerifyURL: srv.URL,
+		CaptchaMinScore:  0.9,
+		CaptchaSites: []CaptchaSite{
+			{Hostname: "faucet.example.com", Secret: "angular-secret", MinScore: withMinScore(0.5), MaxChallengeAge: 5 * time.Minute},
+			{Hostname: "react.example.org", Secret: "react-secret"},
+			{Hostname: "vue.example.net", Secret: "vue-secret", MinScore: withMinScore(0)},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		origin  string
+		wantErr bool
+	}{
+		// Passes the lower min score and longer challenge age of the site.
+		{name: "angular_subdomain", origin: "https://ng.faucet.example.com"},
+		// Fails the default min score of the site.
+		{name: "react", origin: "https://react.example.org", wantErr: true},
+		// Accepts every score with a min score of 0.
+		{name: "vue", origin: "https://vue.example.net"},
+		{name: "unknown_origin", origin: "https://phishing.test", wantErr: true},
+		{name: "no_origin", origin: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := v.verify(context.Background(), "192.0.0.1", tt.origin, "token", walletAddress)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("verify() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+	if got := v.maxChallengeAge(); got != 5*time.Minute {
+		t.Errorf("Wanted max challenge age of 5m, got %v", got)
+	}
+}
@@ -0,0 +1,159 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+const (
+	autoTxType       = "auto"
+	dynamicFeeTxType = "dynamic"
+	legacyTxType     = "legacy"
+)
+
+// Builds the unsigned funding transaction making the payment. Dynamic fee transactions tip the
+// suggested priority fee and cap their fee at twice the latest base fee plus
+// the tip, so they stay includable while the base fee rises for a few blocks.
+// Legacy transactions pay the suggested gas price. Both are bounded by the
+// configured fee ceilings.
+func (s *Server) newFundingTx(ctx context.Context, nonce uint64, p payment) (*types.Transaction, error) {
+	txType := s.cfg.TxType
+	var baseFee *big.Int
+	if txType == "" || txType == autoTxType || txType == dynamicFeeTxType {
+		head, err := s.client.HeaderByNumber(ctx, nil)
+		if err != nil {
+			return nil, fmt.Errorf("could not get latest header: %w", err)
+		}
+		baseFee = head.BaseFee
+		if baseFee == nil && txType == dynamicFeeTxType {
+			return nil, errors.New("chain does not support dynamic fee transactions")
+		}
+	}
+	if baseFee == nil {
+		return s.newLegacyTx(ctx, nonce, p)
+	}
+	return s.newDynamicFeeTx(ctx, nonce, p, baseFee)
+}
+
+func (s *Server) newDynamicFeeTx(
+	ctx context.Context, nonce uint64, p payment, baseFee *big.Int,
+) (*types.Transaction, error) {
+	if baseFee.Cmp(s.maxFeePerGas) > 0 {
+		return nil, fmt.Errorf("base fee %v above max fee per gas %v", baseFee, s.maxFeePerGas)
+	}
+	tip, err := s.client.SuggestGasTipCap(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not suggest gas tip cap: %w", err)
+	}
+	tip = minBig(tip, s.maxPriorityFeePerGas)
+	feeCap := new(big.Int).Add(new(big.Int).Mul(baseFee, big.NewInt(2)), tip)
+	feeCap = minBig(feeCap, s.maxFeePerGas)
+	return types.NewTx(&types.DynamicFeeTx{
+		ChainID:   big.NewInt(s.cfg.ChainId),
+		Nonce:     nonce,
+		GasTipCap: minBig(tip, feeCap),
+		GasFeeCap: feeCap,
+		Gas:       p.gas,
+		To:        &p.to,
+		Value:     p.value,
+		Data:      p.data,
+	}), nil
+}
+
+func (s *Server) newLegacyTx(ctx context.Context, nonce uint64, p payment) (*types.Transaction, error) {
+	gasPrice, err := s.client.SuggestGasPrice(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not suggest gas price: %w", err)
+	}
+	return types.NewTx(&types.LegacyTx{
+		Nonce:    nonce,
+		GasPrice: minBig(gasPrice, s.maxFeePerGas),
+		Gas:      p.gas,
+		To:       &p.to,
+		Value:    p.value,
+		Data:     p.data,
+	}), nil
+}
+
+// Nodes only accept a transaction replacing a pending one at the same nonce if
+// it raises every fee by at least this percentage.
+const replacementFeeBump = 10
+
+var errFeeCeiling = errors.New("replacement fees would exceed the fee ceiling")
+
+// Builds the unsigned replacement of a stuck transaction at the same nonce. Its
+// fees are the bumped fees of the stuck transaction or the currently suggested
+// fees, whichever are higher, bounded by the replacement fee ceiling.
+func (s *Server) newReplacementTx(ctx context.Context, stuck *types.Transaction) (*types.Transaction, error) {
+	if stuck.Type() != types.DynamicFeeTxType {
+		gasPrice, err := s.client.SuggestGasPrice(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("could not suggest gas price: %w", err)
+		}
+		minGasPrice := bumpFee(stuck.GasPrice())
+		gasPrice = minBig(maxBig(gasPrice, minGasPrice), s.maxReplacementFeePerGas)
+		if gasPrice.Cmp(minGasPrice) < 0 {
+			return nil, errFeeCeiling
+		}
+		return types.NewTx(&types.LegacyTx{
+			Nonce:    stuck.Nonce(),
+			GasPrice: gasPrice,
+			Gas:      stuck.Gas(),
+			To:       stuck.To(),
+			Value:    stuck.Value(),
+			Data:     stuck.Data(),
+		}), nil
+	}
+
+	head, err := s.client.HeaderByNumber(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not get latest header: %w", err)
+	}
+	tip, err := s.client.SuggestGasTipCap(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not suggest gas tip cap: %w", err)
+	}
+	minTip, minFeeCap := bumpFee(stuck.GasTipCap()), bumpFee(stuck.GasFeeCap())
+	tip = maxBig(tip, minTip)
+	feeCap := new(big.Int).Add(new(big.Int).Mul(head.BaseFee, big.NewInt(2)), tip)
+	feeCap = minBig(maxBig(feeCap, minFeeCap), s.maxReplacementFeePerGas)
+	tip = minBig(tip, feeCap)
+	if feeCap.Cmp(minFeeCap) < 0 || tip.Cmp(minTip) < 0 {
+		return nil, errFeeCeiling
+	}
+	return types.NewTx(&types.DynamicFeeTx{
+		ChainID:   stuck.ChainId(),
+		Nonce:     stuck.Nonce(),
+		GasTipCap: tip,
+		GasFeeCap: feeCap,
+		Gas:       stuck.Gas(),
+		To:        stuck.To(),
+		Value:     stuck.Value(),
+		Data:      stuck.Data(),
+	}), nil
+}
+
+// Raises the fee by the replacement bump, plus one wei so even a zero fee rises.
+func bumpFee(fee *big.Int) *big.Int {
+	bumped := new(big.Int).Mul(fee, big.NewInt(100+replacementFeeBump))
+	bumped.Div(bumped, big.NewInt(100))
+	return bumped.Add(bumped, big.NewInt(1))
+}
+
+func maxBig(a, b *big.Int) *big.Int {
+	if a.Cmp(b) > 0 {
+		return a
+	}
+	return b
+}
+
+func minBig(a, b *big.Int) *big.Int {
+	if a.Cmp(b) < 0 {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,230 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+func TestServer_newFundingTx(t *testing.T) {
+	gwei := func(n int64) *big.Int {
+		return big.NewInt(n * params.GWei)
+	}
+	tests := []struct {
+		name       string
+		txType     string
+		client     *fakeClient
+		wantType   uint8
+		wantTip    *big.Int
+		wantFeeCap *big.Int
+		wantErr    bool
+	}{
+		{
+			name:       "dynamic_fees_from_base_fee_and_tip",
+			client:     &fakeClient{baseFee: gwei(10), gasTip: gwei(1)},
+			wantType:   types.DynamicFeeTxType,
+			wantTip:    gwei(1),
+			wantFeeCap: gwei(21),
+		},
+		{
+			name:       "tip_capped_at_max_priority_fee",
+			client:     &fakeClient{baseFee: gwei(10), gasTip: gwei(5)},
+			wantType:   types.DynamicFeeTxType,
+			wantTip:    gwei(2),
+			wantFeeCap: gwei(22),
+		},
+		{
+			name:       "fee_cap_capped_at_max_fee",
+			client:     &fakeClient{baseFee: gwei(60), gasTip: gwei(1)},
+			wantType:   types.DynamicFeeTxType,
+			wantTip:    gwei(1),
+			wantFeeCap: gwei(100),
+		},
+		{
+			name:    "base_fee_above_max_fee",
+			client:  &fakeClient{baseFee: gwei(101)},
+			wantErr: true,
+		},
+		{
+			name:       "legacy_before_london",
+			client:     &fakeClient{gasPrice: gwei(3)},
+			wantType:   types.LegacyTxType,
+			wantFeeCap: gwei(3),
+		},
+		{
+			name:       "legacy_gas_price_capped_at_max_fee",
+			client:     &fakeClient{gasPrice: gwei(150)},
+			wantType:   types.LegacyTxType,
+			wantFeeCap: gwei(100),
+		},
+		{
+			name:       "forced_legacy_after_london",
+			txType:     legacyTxType,
+			client:     &fakeClient{baseFee: gwei(10), gasPrice: gwei(12)},
+			wantType:   types.LegacyTxType,
+			wantFeeCap: gwei(12),
+		},
+		{
+			name:    "forced_dynamic_before_london",
+			txType:  dynamicFeeTxType,
+			client:  &fakeClient{},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newTestServer(t, newSimpleRateLimiter(testRateLimits(5, 5, 0)), tt.client)
+			srv.cfg.TxType = tt.txType
+			to := common.HexToAddress("0x0101010101010101010101010101010101010101")
+			tx, err := srv.newFundingTx(context.Background(), 3, srv.ethPayment(to))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newFundingTx() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if tx.Type() != tt.wantType {
+				t.Errorf("Wanted tx type %d, got %d", tt.wantType, tx.Type())
+			}
+			if tx.GasFeeCap().Cmp(tt.wantFeeCap) != 0 {
+				t.Errorf("Wanted fee cap %v, got %v", tt.wantFeeCap, tx.GasFeeCap())
+			}
+			if tt.wantTip != nil && tx.GasTipCap().Cmp(tt.wantTip) != 0 {
+				t.Errorf("Wanted tip %v, got %v", tt.wantTip, tx.GasTipCap())
+			}
+			if tx.Nonce() != 3 || *tx.To() != to || tx.Value().Cmp(srv.fundingAmount) != 0 {
+				t.Errorf("Wanted funding tx to %s with nonce 3, got %v", to.Hex(), tx)
+			}
+		})
+	}
+}
+
+func TestServer_broadcastFunding_signsDynamicFeeTx(t *testing.T) {
+	client := &fakeClient{baseFee: big.NewInt(params.GWei)}
+	srv := newTestServer(t, newSimpleRateLimiter(testRateLimits(5, 5, 0)), client)
+	tx, err := srv.broadcastFunding(context.Background(), srv.funders.funders[0], srv.ethPayment(common.HexToAddress("0x0101010101010101010101010101010101010101")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tx.Type() != types.DynamicFeeTxType {
+		t.Errorf("Wanted a dynamic fee tx, got type %d", tx.Type())
+	}
+	sender, err := types.Sender(types.NewLondonSigner(big.NewInt(srv.cfg.ChainId)), tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if funder := srv.funders.funders[0].address; sender != funder {
+		t.Errorf("Wanted tx signed by %s, got %s", funder.Hex(), sender.Hex())
+	}
+}
+
+func TestServer_newReplacementTx(t *testing.T) {
+	gwei := func(n float64) *big.Int {
+		wei, _ := new(big.Float).Mul(big.NewFloat(n), big.NewFloat(params.GWei)).Int(nil)
+		return wei
+	}
+	to := common.HexToAddress("0x0101010101010101010101010101010101010101")
+	dynamicTx := types.NewTx(&types.DynamicFeeTx{
+		ChainID:   big.NewInt(5),
+		Nonce:     7,
+		GasTipCap: gwei(1),
+		GasFeeCap: gwei(3),
+		Gas:       21000,
+		To:        &to,
+		Value:     big.NewInt(params.Ether),
+	})
+	legacyTx := types.NewTx(&types.LegacyTx{
+		Nonce:    7,
+		GasPrice: gwei(3),
+		Gas:      21000,
+		To:       &to,
+		Value:    big.NewInt(params.Ether),
+	})
+	tests := []struct {
+		name       string
+		stuck      *types.Transaction
+		client     *fakeClient
+		ceiling    *big.Int
+		wantTip    *big.Int
+		wantFeeCap *big.Int
+		wantErr    error
+	}{
+		{
+			name:       "dynamic_fees_bumped",
+			stuck:      dynamicTx,
+			client:     &fakeClient{baseFee: gwei(1), gasTip: gwei(1)},
+			wantTip:    new(big.Int).Add(gwei(1.1), big.NewInt(1)),
+			wantFeeCap: new(big.Int).Add(gwei(3.3), big.NewInt(1)),
+		},
+		{
+			name:       "dynamic_fees_follow_rising_base_fee",
+			stuck:      dynamicTx,
+			client:     &fakeClient{baseFee: gwei(5), gasTip: gwei(2)},
+			wantTip:    gwei(2),
+			wantFeeCap: gwei(12),
+		},
+		{
+			name:       "dynamic_fee_cap_bounded_by_ceiling",
+			stuck:      dynamicTx,
+			client:     &fakeClient{baseFee: gwei(5), gasTip: gwei(2)},
+			ceiling:    gwei(10),
+			wantTip:    gwei(2),
+			wantFeeCap: gwei(10),
+		},
+		{
+			name:    "dynamic_bump_above_ceiling",
+			stuck:   dynamicTx,
+			client:  &fakeClient{baseFee: gwei(1), gasTip: gwei(1)},
+			ceiling: gwei(3.3),
+			wantErr: errFeeCeiling,
+		},
+		{
+			name:       "legacy_gas_price_bumped",
+			stuck:      legacyTx,
+			client:     &fakeClient{gasPrice: gwei(2)},
+			wantFeeCap: new(big.Int).Add(gwei(3.3), big.NewInt(1)),
+		},
+		{
+			name:       "legacy_gas_price_follows_suggestion",
+			stuck:      legacyTx,
+			client:     &fakeClient{gasPrice: gwei(4)},
+			wantFeeCap: gwei(4),
+		},
+		{
+			name:    "legacy_bump_above_ceiling",
+			stuck:   legacyTx,
+			client:  &fakeClient{gasPrice: gwei(2)},
+			ceiling: gwei(3),
+			wantErr: errFeeCeiling,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newTestServer(t, newSimpleRateLimiter(testRateLimits(5, 5, 0)), tt.client)
+			if tt.ceiling != nil {
+				srv.maxReplacementFeePerGas = tt.ceiling
+			}
+			tx, err := srv.newReplacementTx(context.Background(), tt.stuck)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("newReplacementTx() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+			if tx.Type() != tt.stuck.Type() || tx.Nonce() != tt.stuck.Nonce() || *tx.To() != to || tx.Value().Cmp(tt.stuck.Value()) != 0 {
+				t.Errorf("Wanted replacement of %v at the same nonce, got %v", tt.stuck, tx)
+			}
+			if tx.GasFeeCap().Cmp(tt.wantFeeCap) != 0 {
+				t.Errorf("Wanted fee cap %v, got %v", tt.wantFeeCap, tx.GasFeeCap())
+			}
+			if tt.wantTip != nil && tx.GasTipCap().Cmp(tt.wantTip) != 0 {
+				t.Errorf("Wanted tip %v, got %v", tt.wantTip, tx.GasTipCap())
+			}
+		})
+	}
+}
@@ -0,0 +1,193 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+const (
+	mostBalanceStrategy   = "balance"
+	fewestPendingStrategy = "pending"
+)
+
+var errNoFunder = errors.New("no funder account has enough balance")
+
+// Account paying for funding transactions, with its own nonce sequence.
+type funder struct {
+	address common.Address
+	signer  txSigner
+	nonces  *nonceManager
+	pending int
+}
+
+// Funder pool spreads funding transactions over several funder accounts, so
+// they are sent over independent nonce sequences and a drained account does
+// not take the faucet down. Each request is paid by the account with the most
+// balance of the requested asset, or the fewest pending transactions, among
+// the accounts which can pay for it. ETH requests need accounts holding at
+// least the min balance and the funding amount, token requests need accounts
+// holding at least the min balance for gas and the token amount.
+//
+// Balances only drop once transactions mine, so the amount sent by the pending
+// requests of an account is taken off its balance, spreading bursts of requests
+// over the accounts. Balances are cached for a short while, and until a request
+// of the account is released, so picking a funder does not query the node for
+// every account on every request.
+type funderPool struct {
+	mutex         sync.Mutex
+	client        ethClient
+	funders       []*funder
+	strategy      string
+	minBalance    *big.Int
+	fundingAmount *big.Int
+	balances      map[balanceKey]cachedBalance
+	balanceTTL    time.Duration
+}
+
+// Balance of an asset held by a funder account, the zero token address
+// standing for ETH.
+type balanceKey struct {
+	funder common.Address
+	token  common.Address
+}
+
+type cachedBalance struct {
+	balance   *big.Int
+	fetchedAt time.Time
+}
+
+func newFunderPool(client ethClient, signers []txSigner, strategy string, minBalance, fundingAmount *big.Int) *funderPool {
+	funders := make([]*funder, len(signers))
+	for i, signer := range signers {
+		address := signer.account()
+		funders[i] = &funder{
+			address: address,
+			signer:  signer,
+			nonces:  newNonceManager(client, address),
+		}
+	}
+	return &funderPool{
+		client:        client,
+		funders:       funders,
+		strategy:      strategy,
+		minBalance:    minBalance,
+		fundingAmount: fundingAmount,
+		balances:      make(map[balanceKey]cachedBalance),
+		balanceTTL:    5 * time.Second, /* Refresh funder balances every 5 seconds */
+	}
+}
+
+// Picks the funder account paying for a request in ETH, or in the token if
+// not nil, counting the request as pending on it until it is released.
+func (p *funderPool) acquire(ctx context.Context, token *erc20Token) (*funder, error) {
+	required, spend := maxBig(p.minBalance, p.fundingAmount), p.fundingAmount
+	if token != nil {
+		required, spend = token.amount, token.amount
+	}
+	now := time.Now()
+	balances := make([]*big.Int, len(p.funders))
+	var balanceErr error
+	for i, f := range p.funders {
+		bal, err := p.cachedBalance(ctx, f.address, token, now)
+		if err != nil {
+			log.WithError(err).WithField("funder", f.address.Hex()).Warn("Could not get funder balance")
+			balanceErr = err
+			continue
+		}
+		balances[i] = bal
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	var best *funder
+	var bestBalance *big.Int
+	for i, f := range p.funders {
+		if balances[i] == nil {
+			continue
+		}
+		pendingSpend := new(big.Int).Mul(big.NewInt(int64(f.pending)), spend)
+		bal := new(big.Int).Sub(balances[i], pendingSpend)
+		if bal.Cmp(required) < 0 {
+			continue
+		}
+		if best == nil || p.better(f, bal, best, bestBalance) {
+			best, bestBalance = f, bal
+		}
+	}
+	if best == nil {
+		if balanceErr != nil {
+			return nil, fmt.Errorf("could not get funder balance: %w", balanceErr)
+		}
+		return nil, errNoFunder
+	}
+	best.pending++
+	return best, nil
+}
+
+// Balance of the requested asset held by the funder account, as long as it
+// was fetched within the balance ttl.
+func (p *funderPool) cachedBalance(
+	ctx context.Context, address common.Address, token *erc20Token, now time.Time,
+) (*big.Int, error) {
+	key := balanceKey{funder: address}
+	if token != nil {
+		key.token = token.address
+	}
+	p.mutex.Lock()
+	cached, ok := p.balances[key]
+	p.mutex.Unlock()
+	if ok && now.Sub(cached.fetchedAt) < p.balanceTTL {
+		return cached.balance, nil
+	}
+	bal, err := p.balance(ctx, address, token)
+	if err != nil {
+		return nil, err
+	}
+	p.mutex.Lock()
+	p.balances[key] = cachedBalance{balance: bal, fetchedAt: now}
+	p.mutex.Unlock()
+	return bal, nil
+}
+
+// Balance of the requested asset held by the funder account. Accounts without
+// the min balance for gas cannot pay for token transfers, so they hold none.
+func (p *funderPool) balance(ctx context.Context, address common.Address, token *erc20Token) (*big.Int, error) {
+	bal, err := p.client.BalanceAt(ctx, address, nil)
+	if err != nil || token == nil {
+		return bal, err
+	}
+	if bal.Cmp(p.minBalance) < 0 {
+		return new(big.Int), nil
+	}
+	return token.balanceOf(ctx, p.client, address)
+}
+
+// Whether the funder is a better pick than the current best one under the
+// pool's strategy, falling back to the other criterion on ties. Requires the lock.
+func (p *funderPool) better(f *funder, bal *big.Int, best *funder, bestBalance *big.Int) bool {
+	byBalance := bal.Cmp(bestBalance)
+	byPending := best.pending - f.pending
+	if p.strategy == fewestPendingStrategy {
+		return byPending > 0 || byPending == 0 && byBalance > 0
+	}
+	return byBalance > 0 || byBalance == 0 && byPending > 0
+}
+
+// Stops counting a request as pending on its funder, whose balances are
+// fetched again as the request may have spent from them.
+func (p *funderPool) release(f *funder) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	f.pending--
+	for key := range p.balances {
+		if key.funder == f.address {
+			delete(p.balances, key)
+		}
+	}
+}
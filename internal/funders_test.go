@@ -0,0 +1,206 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/params"
+	faucetpb "github.com/rauljordan/eth-faucet/proto/faucet"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Ethereum client whose node cannot tell balances.
+type balanceErrClient struct {
+	*fakeClient
+}
+
+func (c *balanceErrClient) BalanceAt(_ context.Context, _ common.Address, _ *big.Int) (*big.Int, error) {
+	return nil, errors.New("connection refused")
+}
+
+func generateFunderSigners(t *testing.T, n int) []txSigner {
+	signers := make([]txSigner, n)
+	for i := range signers {
+		pk, err := crypto.GenerateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		signers[i] = &keySigner{pk: pk}
+	}
+	return signers
+}
+
+func Test_funderPool_acquire(t *testing.T) {
+	signers := generateFunderSigners(t, 3)
+	addresses := make([]common.Address, len(signers))
+	for i, signer := range signers {
+		addresses[i] = signer.account()
+	}
+	eth := func(n int64) *big.Int {
+		return new(big.Int).Mul(big.NewInt(n), big.NewInt(params.Ether))
+	}
+	client := &fakeClient{balances: map[common.Address]*big.Int{
+		addresses[0]: eth(10),
+		addresses[1]: eth(20),
+		addresses[2]: eth(1),
+	}}
+	acquire := func(p *funderPool) common.Address {
+		f, err := p.acquire(context.Background(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f.address
+	}
+
+	t.Run("most_balance", func(t *testing.T) {
+		p := newFunderPool(client, signers, mostBalanceStrategy, eth(5), eth(1))
+		for i := 0; i < 3; i++ {
+			if got := acquire(p); got != addresses[1] {
+				t.Errorf("Wanted funder %s with the most balance, got %s", addresses[1].Hex(), got.Hex())
+			}
+		}
+	})
+
+	t.Run("fewest_pending", func(t *testing.T) {
+		p := newFunderPool(client, signers, fewestPendingStrategy, eth(5), eth(1))
+		// Ties go to the funder with the most balance, and funders below the
+		// min balance are skipped.
+		want := []common.Address{addresses[1], addresses[0], addresses[1], addresses[0]}
+		var got []common.Address
+		for range want {
+			got = append(got, acquire(p))
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("Wanted funder %s for request %d, got %s", want[i].Hex(), i, got[i].Hex())
+			}
+		}
+		p.release(p.funders[0])
+		p.release(p.funders[0])
+		if got := acquire(p); got != addresses[0] {
+			t.Errorf("Wanted released funder %s, got %s", addresses[0].Hex(), got.Hex())
+		}
+	})
+
+	t.Run("all_below_min_balance", func(t *testing.T) {
+		p := newFunderPool(client, signers, mostBalanceStrategy, eth(50), eth(1))
+		if _, err := p.acquire(context.Background(), nil); !errors.Is(err, errNoFunder) {
+			t.Errorf("Wanted %v, got %v", errNoFunder, err)
+		}
+	})
+
+	t.Run("balances_unavailable", func(t *testing.T) {
+		p := newFunderPool(&balanceErrClient{fakeClient: client}, signers, mostBalanceStrategy, eth(5), eth(1))
+		if _, err := p.acquire(context.Background(), nil); err == nil || errors.Is(err, errNoFunder) {
+			t.Errorf("Wanted balance error, got %v", err)
+		}
+	})
+
+	t.Run("burst", func(t *testing.T) {
+		burstClient := &fakeClient{balances: map[common.Address]*big.Int{
+			addresses[0]: eth(10),
+			addresses[1]: eth(9),
+			addresses[2]: eth(1),
+		}}
+		p := newFunderPool(burstClient, signers, mostBalanceStrategy, eth(1), eth(1))
+		// Requests in flight take their funding amount off the balance of
+		// their funder, so a burst is spread over the funders.
+		want := []common.Address{addresses[0], addresses[1], addresses[0], addresses[1], addresses[0]}
+		for i := range want {
+			if got := acquire(p); got != want[i] {
+				t.Errorf("Wanted funder %s for request %d, got %s", want[i].Hex(), i, got.Hex())
+			}
+		}
+	})
+}
+
+// Ethereum client counting the balances asked of the node.
+type countingBalanceClient struct {
+	*fakeClient
+	calls map[common.Address]int
+}
+
+func (c *countingBalanceClient) BalanceAt(ctx context.Context, account common.Address, block *big.Int) (*big.Int, error) {
+	c.calls[account]++
+	return c.fakeClient.BalanceAt(ctx, account, block)
+}
+
+func Test_funderPool_cachesBalances(t *testing.T) {
+	signers := generateFunderSigners(t, 2)
+	client := &countingBalanceClient{fakeClient: &fakeClient{}, calls: make(map[common.Address]int)}
+	p := newFunderPool(client, signers, mostBalanceStrategy, new(big.Int), big.NewInt(params.Ether))
+	first, err := p.acquire(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.acquire(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, signer := range signers {
+		if got := client.calls[signer.account()]; got != 1 {
+			t.Errorf("Wanted the balance of %s to be fetched once, got %d", signer.account().Hex(), got)
+		}
+	}
+
+	// Released requests may have spent from their funder, so its balance is
+	// fetched again, and so are balances older than the ttl.
+	p.release(first)
+	if _, err := p.acquire(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, signer := range signers {
+		want := 1
+		if signer.account() == first.address {
+			want = 2
+		}
+		if got := client.calls[signer.account()]; got != want {
+			t.Errorf("Wanted the balance of %s to be fetched %d times, got %d", signer.account().Hex(), want, got)
+		}
+	}
+	p.balanceTTL = 0
+	if _, err := p.acquire(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, signer := range signers {
+		if got := client.calls[signer.account()]; got < 2 {
+			t.Errorf("Wanted the balance of %s to be fetched again after the ttl, got %d fetches", signer.account().Hex(), got)
+		}
+	}
+}
+
+func TestServer_RequestFunds_funderPool(t *testing.T) {
+	signers := generateFunderSigners(t, 2)
+	drained := signers[0].account()
+	funded := signers[1].account()
+	client := &fakeClient{balances: map[common.Address]*big.Int{drained: big.NewInt(1)}}
+	srv := newTestServer(t, newSimpleRateLimiter(testRateLimits(5, 5, 0)), client)
+	srv.funders = newFunderPool(client, signers, mostBalanceStrategy, new(big.Int), srv.fundingAmount)
+
+	ethAddress := "0x0101010101010101010101010101010101010101"
+	resp, err := srv.RequestFunds(requestContext("192.0.0.1"), captchaFundingRequest(ethAddress))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.FunderAddress != funded.Hex() {
+		t.Errorf("Wanted funder %s in response, got %s", funded.Hex(), resp.FunderAddress)
+	}
+	st, err := srv.GetFundingStatus(context.Background(), &faucetpb.FundingStatusRequest{RequestId: resp.RequestId})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.FunderAddress != funded.Hex() {
+		t.Errorf("Wanted funder %s in status, got %s", funded.Hex(), st.FunderAddress)
+	}
+
+	// Once every funder is drained the faucet is out of funds.
+	client.balances[funded] = big.NewInt(1)
+	_, err = srv.RequestFunds(requestContext("192.0.0.1"), captchaFundingRequest(ethAddress))
+	if status.Code(err) != codes.Unavailable {
+		t.Errorf("Wanted code %v, got %v", codes.Unavailable, err)
+	}
+}
@@ -0,0 +1,146 @@
+package internal
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	faucetpb "github.com/rauljordan/eth-faucet/proto/faucet"
+)
+
+// Funding requests keep track of the state of every funding request, so clients
+// which don't wait for their transaction to mine can poll for it. Requests are
+// forgotten once they have been finished for longer than the retention period.
+// They are kept in the memory of each faucet process, and not shared between
+// replicas.
+type fundingRequests struct {
+	mutex           sync.Mutex
+	retention       time.Duration
+	requests        map[string]*fundingRequest
+	refreshInterval time.Duration
+}
+
+type fundingRequest struct {
+	id          string
+	funder      common.Address
+	state       faucetpb.FundingState
+	txHash      common.Hash
+	blockNumber uint64
+	err         string
+	finishedAt  time.Time
+}
+
+func newFundingRequests(retention time.Duration) *fundingRequests {
+	return &fundingRequests{
+		retention:       retention,
+		requests:        make(map[string]*fundingRequest),
+		refreshInterval: time.Minute, /* Prune finished requests every minute */
+	}
+}
+
+// Queues a new funding request paid by the funder, returning its random id.
+func (f *fundingRequests) add(funder common.Address) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("could not generate request id: %w", err)
+	}
+	id := hex.EncodeToString(b)
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.requests[id] = &fundingRequest{
+		id:     id,
+		funder: funder,
+		state:  faucetpb.FundingState_QUEUED,
+	}
+	return id, nil
+}
+
+func (f *fundingRequests) broadcast(id string, txHash common.Hash) {
+	f.update(id, func(r *fundingRequest) {
+		r.state = faucetpb.FundingState_BROADCAST
+		r.txHash = txHash
+	})
+}
+
+// Records the transaction which mined, which may be a replacement of the one
+// broadcast first.
+func (f *fundingRequests) mined(id string, txHash common.Hash, blockNumber uint64) {
+	f.update(id, func(r *fundingRequest) {
+		r.state = faucetpb.FundingState_MINED
+		r.txHash = txHash
+		r.blockNumber = blockNumber
+	})
+}
+
+func (f *fundingRequests) confirmed(id string) {
+	f.update(id, func(r *fundingRequest) {
+		r.state = faucetpb.FundingState_CONFIRMED
+		r.finishedAt = time.Now()
+	})
+}
+
+func (f *fundingRequests) failed(id string, err error) {
+	f.update(id, func(r *fundingRequest) {
+		r.state = faucetpb.FundingState_FAILED
+		r.err = err.Error()
+		r.finishedAt = time.Now()
+	})
+}
+
+func (f *fundingRequests) update(id string, apply func(r *fundingRequest)) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if r, ok := f.requests[id]; ok {
+		apply(r)
+	}
+}
+
+// Status of the request, or nil if it is unknown or was already forgotten.
+func (f *fundingRequests) status(id string) *faucetpb.FundingStatusResponse {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	r, ok := f.requests[id]
+	if !ok {
+		return nil
+	}
+	resp := &faucetpb.FundingStatusResponse{
+		RequestId:     r.id,
+		FunderAddress: r.funder.Hex(),
+		State:         r.state,
+		BlockNumber:   r.blockNumber,
+		Error:         r.err,
+	}
+	if r.txHash != (common.Hash{}) {
+		resp.TransactionHash = r.txHash.Hex()
+	}
+	return resp
+}
+
+// Forget finished requests after the retention period every so often.
+func (f *fundingRequests) refresh(ctx context.Context) {
+	ticker := time.NewTicker(f.refreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			f.mutex.Lock()
+			f.pruneFinished(now)
+			f.mutex.Unlock()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Evicts every request which finished before the retention period. Requires the lock.
+func (f *fundingRequests) pruneFinished(now time.Time) {
+	for id, r := range f.requests {
+		if !r.finishedAt.IsZero() && now.Sub(r.finishedAt) >= f.retention {
+			delete(f.requests, id)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package internal
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	faucetpb "github.com/rauljordan/eth-faucet/proto/faucet"
+)
+
+func Test_fundingRequests_states(t *testing.T) {
+	f := newFundingRequests(time.Hour)
+	funder := common.HexToAddress("0x0a")
+	id, err := f.add(funder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := f.status(id); st.State != faucetpb.FundingState_QUEUED || st.TransactionHash != "" || st.FunderAddress != funder.Hex() {
+		t.Errorf("Wanted queued request paid by %s without tx, got %v", funder.Hex(), st)
+	}
+
+	txHash := common.HexToHash("0x01")
+	f.broadcast(id, txHash)
+	if st := f.status(id); st.State != faucetpb.FundingState_BROADCAST || st.TransactionHash != txHash.Hex() {
+		t.Errorf("Wanted broadcast request with tx %s, got %v", txHash.Hex(), st)
+	}
+	replacementHash := common.HexToHash("0x02")
+	f.mined(id, replacementHash, 42)
+	if st := f.status(id); st.State != faucetpb.FundingState_MINED || st.BlockNumber != 42 || st.TransactionHash != replacementHash.Hex() {
+		t.Errorf("Wanted request mined with tx %s in block 42, got %v", replacementHash.Hex(), st)
+	}
+	f.confirmed(id)
+	if st := f.status(id); st.State != faucetpb.FundingState_CONFIRMED {
+		t.Errorf("Wanted confirmed request, got %v", st)
+	}
+
+	failedID, err := f.add(funder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.failed(failedID, errors.New("insufficient funds"))
+	if st := f.status(failedID); st.State != faucetpb.FundingState_FAILED || st.Error != "insufficient funds" {
+		t.Errorf("Wanted failed request with its error, got %v", st)
+	}
+	if failedID == id {
+		t.Error("Wanted unique request ids")
+	}
+	if f.status("unknown") != nil {
+		t.Error("Wanted no status for an unknown request")
+	}
+}
+
+func Test_fundingRequests_pruneFinished(t *testing.T) {
+	f := newFundingRequests(time.Hour)
+	funder := common.HexToAddress("0x0a")
+	pending, err := f.add(funder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	finished, err := f.add(funder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.confirmed(finished)
+
+	f.pruneFinished(time.Now().Add(30 * time.Minute))
+	if f.status(finished) == nil {
+		t.Error("Wanted finished request kept within the retention period")
+	}
+	f.pruneFinished(time.Now().Add(2 * time.Hour))
+	if f.status(finished) != nil {
+		t.Error("Wanted finished request forgotten after the retention period")
+	}
+	if f.status(pending) == nil {
+		t.Error("Wanted pending request kept")
+	}
+}
@@ -0,0 +1,89 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	gwruntime "github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	faucetpb "github.com/rauljordan/eth-faucet/proto/faucet"
+	"github.com/rs/cors"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// Initialize a gRPC gateway which translates http JSON requests into calls
+// to the gRPC server.
+func (s *Server) initializeGateway(ctx context.Context, gatewayAddress, grpcAddress string) (*http.Server, error) {
+	gwmux := gwruntime.NewServeMux(
+		gwruntime.WithMarshalerOption(
+			gwruntime.MIMEWildcard, &gwruntime.JSONPb{},
+		),
+		gwruntime.WithErrorHandler(retryAfterErrorHandler),
+		gwruntime.WithIncomingHeaderMatcher(apiKeyHeaderMatcher),
+	)
+	opts := []grpc.DialOption{grpc.WithInsecure()}
+	if err := faucetpb.RegisterFaucetHandlerFromEndpoint(ctx, gwmux, grpcAddress, opts); err != nil {
+		return nil, fmt.Errorf("could not register API handler with grpc endpoint: %w", err)
+	}
+	c := cors.New(cors.Options{
+		AllowedOrigins:   s.cfg.AllowedOrigins,
+		AllowedMethods:   []string{http.MethodPost, http.MethodGet, http.MethodOptions},
+		AllowCredentials: true,
+		MaxAge:           600,
+		AllowedHeaders:   []string{"*"},
+	})
+	return &http.Server{
+		Addr:    gatewayAddress,
+		Handler: c.Handler(gwmux),
+	}, nil
+}
+
+// Forwards the api key header to the gRPC server along with the default headers.
+func apiKeyHeaderMatcher(key string) (string, bool) {
+	if strings.EqualFold(key, apiKeyHeader) {
+		return apiKeyHeader, true
+	}
+	return gwruntime.DefaultHeaderMatcher(key)
+}
+
+// Serves errors carrying google.rpc.RetryInfo details as 429 Too Many Requests
+// with a Retry-After header, and every other error as the gateway would by default.
+func retryAfterErrorHandler(
+	ctx context.Context,
+	mux *gwruntime.ServeMux,
+	marshaler gwruntime.Marshaler,
+	w http.ResponseWriter,
+	r *http.Request,
+	err error,
+) {
+	if retryDelay, ok := retryDelayFromStatus(status.Convert(err)); ok {
+		w.Header().Set("Retry-After", strconv.FormatInt(int64(math.Ceil(retryDelay.Seconds())), 10))
+		w = &statusCodeWriter{ResponseWriter: w, code: http.StatusTooManyRequests}
+	}
+	gwruntime.DefaultHTTPErrorHandler(ctx, mux, marshaler, w, r, err)
+}
+
+func retryDelayFromStatus(st *status.Status) (time.Duration, bool) {
+	for _, detail := range st.Details() {
+		if info, ok := detail.(*errdetails.RetryInfo); ok && info.RetryDelay != nil {
+			return info.RetryDelay.AsDuration(), true
+		}
+	}
+	return 0, false
+}
+
+// Overrides the status code written by the wrapped response writer.
+type statusCodeWriter struct {
+	http.ResponseWriter
+	code int
+}
+
+func (w *statusCodeWriter) WriteHeader(int) {
+	w.ResponseWriter.WriteHeader(w.code)
+}
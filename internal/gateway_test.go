@@ -0,0 +1,91 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	gwruntime "github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func Test_rateLimitError_grpcStatus(t *testing.T) {
+	resetAt := time.Now().Add(time.Hour)
+	st := (&rateLimitError{
+		limit:   addressLimitPerIP,
+		reason:  "ip 192.0.0.1 requested funds for too many addresses",
+		resetAt: resetAt,
+	}).grpcStatus()
+	if st.Code() != codes.PermissionDenied {
+		t.Errorf("Wanted code %v, got %v", codes.PermissionDenied, st.Code())
+	}
+	var info *errdetails.ErrorInfo
+	var retry *errdetails.RetryInfo
+	for _, detail := range st.Details() {
+		switch d := detail.(type) {
+		case *errdetails.ErrorInfo:
+			info = d
+		case *errdetails.RetryInfo:
+			retry = d
+		}
+	}
+	if info == nil || info.Reason != addressLimitPerIP {
+		t.Errorf("Wanted error info with reason %s, got %v", addressLimitPerIP, info)
+	}
+	if retry == nil {
+		t.Fatal("Wanted retry info in status details")
+	}
+	if d := retry.RetryDelay.AsDuration(); d <= 59*time.Minute || d > time.Hour {
+		t.Errorf("Wanted retry delay of about an hour, got %v", d)
+	}
+}
+
+func Test_retryAfterErrorHandler(t *testing.T) {
+	mux := gwruntime.NewServeMux()
+	marshaler := &gwruntime.JSONPb{}
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/faucet/request", nil)
+
+	t.Run("rate_limited_returns_429", func(t *testing.T) {
+		err := addressCooldownError("0x0101", time.Now().Add(90*time.Second)).(*rateLimitError).grpcStatus().Err()
+		rec := httptest.NewRecorder()
+		retryAfterErrorHandler(context.Background(), mux, marshaler, rec, req, err)
+		if rec.Code != http.StatusTooManyRequests {
+			t.Errorf("Wanted status %d, got %d", http.StatusTooManyRequests, rec.Code)
+		}
+		retryAfter, err := strconv.Atoi(rec.Header().Get("Retry-After"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if retryAfter < 89 || retryAfter > 90 {
+			t.Errorf("Wanted Retry-After of 90 seconds, got %d", retryAfter)
+		}
+	})
+
+	t.Run("other_errors_unchanged", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		retryAfterErrorHandler(context.Background(), mux, marshaler, rec, req, status.Error(codes.InvalidArgument, "bad"))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("Wanted status %d, got %d", http.StatusBadRequest, rec.Code)
+		}
+		if rec.Header().Get("Retry-After") != "" {
+			t.Error("Wanted no Retry-After header")
+		}
+	})
+}
+
+func Test_apiKeyHeaderMatcher(t *testing.T) {
+	if key, ok := apiKeyHeaderMatcher("X-Api-Key"); !ok || key != apiKeyHeader {
+		t.Errorf("Wanted api key header forwarded as %s, got %s", apiKeyHeader, key)
+	}
+	if key, ok := apiKeyHeaderMatcher("Origin"); !ok || key != "grpcgateway-Origin" {
+		t.Errorf("Wanted default headers to be forwarded, got %s", key)
+	}
+	if _, ok := apiKeyHeaderMatcher("X-Custom"); ok {
+		t.Error("Wanted other headers to be dropped")
+	}
+}
@@ -0,0 +1,26 @@
+package internal
+
+import (
+	"context"
+
+	faucetpb "github.com/rauljordan/eth-faucet/proto/faucet"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// GetFundingStatus reports how far along a funding request is, so clients of an
+// asynchronous faucet can poll until their transaction is confirmed. Requests
+// are only known to the replica which took them, so behind a load balancer the
+// status needs to be polled with sticky sessions, or it is not found.
+func (s *Server) GetFundingStatus(
+	_ context.Context, req *faucetpb.FundingStatusRequest,
+) (*faucetpb.FundingStatusResponse, error) {
+	if req.RequestId == "" {
+		return nil, status.Error(codes.InvalidArgument, "Request needs a request id")
+	}
+	resp := s.fundingRequests.status(req.RequestId)
+	if resp == nil {
+		return nil, status.Errorf(codes.NotFound, "Unknown funding request %s", req.RequestId)
+	}
+	return resp, nil
+}
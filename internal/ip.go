@@ -0,0 +1,57 @@
+package internal
+
+import (
+	"net"
+	"strings"
+)
+
+// Picks the client ip address out of the hops of a forwarded-for list. Each
+// proxy appends the address it received the request from, so every hop but the
+// ones appended by the gateway and the trusted proxies in front of it can be
+// set by the client. The hop appended by the outermost trusted proxy is the
+// client's, or the first hop if there are fewer hops than trusted proxies.
+func clientIP(forwardedFor []string, trustedProxies int) string {
+	var hops []string
+	for _, v := range forwardedFor {
+		hops = append(hops, strings.Split(v, ",")...)
+	}
+	i := len(hops) - 1 - trustedProxies
+	if i < 0 {
+		i = 0
+	}
+	return normalizeIP(hops[i])
+}
+
+// Normalizes an ip address from a request into its canonical form, so the
+// same client is always limited under the same key. Turns ipv4-mapped ipv6
+// addresses into ipv4. Addresses which cannot be parsed are returned trimmed
+// but otherwise as is.
+func normalizeIP(ipAddress string) string {
+	ipAddress = strings.TrimSpace(ipAddress)
+	if host, _, err := net.SplitHostPort(ipAddress); err == nil {
+		ipAddress = host
+	}
+	ip := net.ParseIP(ipAddress)
+	if ip == nil {
+		return ipAddress
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return v4.String()
+	}
+	return ip.String()
+}
+
+// Groups an ip address into the subnet of the given prefix length for its
+// address family, such as 192.0.2.0/24 or 2001:db8::/64.
+func ipSubnet(ipAddress string, ipv4PrefixLength, ipv6PrefixLength int) string {
+	ip := net.ParseIP(ipAddress)
+	if ip == nil {
+		return ipAddress
+	}
+	if v4 := ip.To4(); v4 != nil {
+		mask := net.CIDRMask(ipv4PrefixLength, 8*net.IPv4len)
+		return (&net.IPNet{IP: v4.Mask(mask), Mask: mask}).String()
+	}
+	mask := net.CIDRMask(ipv6PrefixLength, 8*net.IPv6len)
+	return (&net.IPNet{IP: ip.Mask(mask), Mask: mask}).String()
+}
@@ -0,0 +1,61 @@
+package internal
+
+import "testing"
+
+func Test_normalizeIP(t *testing.T) {
+	tests := []struct {
+		ipAddress string
+		want      string
+	}{
+		{ipAddress: "192.0.2.1", want: "192.0.2.1"},
+		{ipAddress: "::ffff:192.0.2.1", want: "192.0.2.1"},
+		{ipAddress: "192.0.2.1:5000", want: "192.0.2.1"},
+		{ipAddress: "2001:DB8:0:0::1", want: "2001:db8::1"},
+		{ipAddress: "[2001:db8::1]:5000", want: "2001:db8::1"},
+		{ipAddress: " unknown ", want: "unknown"},
+	}
+	for _, tt := range tests {
+		if got := normalizeIP(tt.ipAddress); got != tt.want {
+			t.Errorf("normalizeIP(%q) = %q, want %q", tt.ipAddress, got, tt.want)
+		}
+	}
+}
+
+func Test_clientIP(t *testing.T) {
+	tests := []struct {
+		name           string
+		forwardedFor   []string
+		trustedProxies int
+		want           string
+	}{
+		{name: "single_hop", forwardedFor: []string{"192.0.2.1"}, want: "192.0.2.1"},
+		{name: "spoofed_hop", forwardedFor: []string{"10.0.0.1, 203.0.113.7"}, want: "203.0.113.7"},
+		{name: "trusted_proxy", forwardedFor: []string{"10.0.0.1, 203.0.113.7, 192.0.2.10"}, trustedProxies: 1, want: "203.0.113.7"},
+		{name: "fewer_hops_than_proxies", forwardedFor: []string{"203.0.113.7"}, trustedProxies: 2, want: "203.0.113.7"},
+		{name: "several_headers", forwardedFor: []string{"10.0.0.1", "203.0.113.7"}, want: "203.0.113.7"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := clientIP(tt.forwardedFor, tt.trustedProxies); got != tt.want {
+				t.Errorf("clientIP(%q, %d) = %q, want %q", tt.forwardedFor, tt.trustedProxies, got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_ipSubnet(t *testing.T) {
+	tests := []struct {
+		ipAddress string
+		want      string
+	}{
+		{ipAddress: "192.0.2.77", want: "192.0.2.0/24"},
+		{ipAddress: "::ffff:192.0.2.77", want: "192.0.2.0/24"},
+		{ipAddress: "2001:db8:1:2:3:4:5:6", want: "2001:db8:1:2::/64"},
+		{ipAddress: "unknown", want: "unknown"},
+	}
+	for _, tt := range tests {
+		if got := ipSubnet(tt.ipAddress, 24, 64); got != tt.want {
+			t.Errorf("ipSubnet(%q) = %q, want %q", tt.ipAddress, got, tt.want)
+		}
+	}
+}
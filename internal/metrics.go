@@ -0,0 +1,34 @@
+package internal
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	captchaFailuresTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "faucet_captcha_failures_total",
+		Help: "Number of funding requests which failed captcha or proof-of-work verification.",
+	})
+	captchaBansTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "faucet_captcha_bans_total",
+		Help: "Number of temporary bans after repeated captcha failures, by banned ip or address.",
+	}, []string{"kind"})
+	captchaBannedRequestsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "faucet_captcha_banned_requests_total",
+		Help: "Number of funding requests rejected because the client was banned.",
+	})
+)
+
+// Initializes an http server exposing the prometheus metrics at /metrics.
+func newMetricsServer(address string) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	return &http.Server{
+		Addr:    address,
+		Handler: mux,
+	}
+}
@@ -0,0 +1,113 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+)
+
+// Nonce manager hands out sequential nonces for the funder's transactions so
+// concurrent funding requests never race for the same nonce. It resyncs with
+// the node's pending nonce on startup and whenever the node rejects a nonce,
+// and reuses nonces of transactions which were never broadcast so they don't
+// leave a gap blocking every later transaction.
+type nonceManager struct {
+	mutex     sync.Mutex
+	client    ethClient
+	account   common.Address
+	synced    bool
+	base      uint64
+	next      uint64
+	reclaimed []uint64
+}
+
+func newNonceManager(client ethClient, account common.Address) *nonceManager {
+	return &nonceManager{
+		client:  client,
+		account: account,
+	}
+}
+
+// Resets the next nonce to the account's pending nonce on the node.
+func (n *nonceManager) sync(ctx context.Context) error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.syncLocked(ctx)
+}
+
+func (n *nonceManager) syncLocked(ctx context.Context) error {
+	nonce, err := n.client.PendingNonceAt(ctx, n.account)
+	if err != nil {
+		return fmt.Errorf("could not get pending nonce: %w", err)
+	}
+	n.base = nonce
+	n.next = nonce
+	n.reclaimed = nil
+	n.synced = true
+	return nil
+}
+
+// Hands out the lowest reclaimed nonce, or else the next one in sequence,
+// syncing with the node first if needed.
+func (n *nonceManager) acquire(ctx context.Context) (uint64, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if !n.synced {
+		if err := n.syncLocked(ctx); err != nil {
+			return 0, err
+		}
+	}
+	if len(n.reclaimed) > 0 {
+		nonce := n.reclaimed[0]
+		n.reclaimed = n.reclaimed[1:]
+		return nonce, nil
+	}
+	nonce := n.next
+	n.next++
+	return nonce, nil
+}
+
+// Returns the nonce of a transaction which was never broadcast so it is
+// handed out again. Nonces at the end of the sequence rewind it instead.
+func (n *nonceManager) release(nonce uint64) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if !n.synced || nonce < n.base || nonce >= n.next {
+		// Handed out before the last resync, which already accounted for it.
+		return
+	}
+	i := sort.Search(len(n.reclaimed), func(i int) bool { return n.reclaimed[i] >= nonce })
+	if i < len(n.reclaimed) && n.reclaimed[i] == nonce {
+		return
+	}
+	n.reclaimed = append(n.reclaimed, 0)
+	copy(n.reclaimed[i+1:], n.reclaimed[i:])
+	n.reclaimed[i] = nonce
+	for len(n.reclaimed) > 0 && n.reclaimed[len(n.reclaimed)-1] == n.next-1 {
+		n.reclaimed = n.reclaimed[:len(n.reclaimed)-1]
+		n.next--
+	}
+}
+
+// Forces a resync with the node before the next nonce is handed out.
+func (n *nonceManager) invalidate() {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.synced = false
+	n.reclaimed = nil
+}
+
+// Whether the node rejected a transaction because its nonce was out of sync.
+// Errors from a remote node only carry the message of the original error.
+func isNonceError(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	return strings.Contains(msg, core.ErrNonceTooLow.Error()) || strings.Contains(msg, core.ErrNonceTooHigh.Error())
+}
@@ -0,0 +1,100 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+func acquireNonces(t *testing.T, n *nonceManager, count int) []uint64 {
+	nonces := make([]uint64, count)
+	for i := range nonces {
+		nonce, err := n.acquire(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		nonces[i] = nonce
+	}
+	return nonces
+}
+
+func Test_nonceManager_acquire(t *testing.T) {
+	client := &fakeClient{sent: []*types.Transaction{types.NewTx(&types.LegacyTx{Nonce: 0})}}
+	n := newNonceManager(client, common.Address{})
+
+	// Syncs with the pending nonce on first use.
+	if got := acquireNonces(t, n, 3); fmt.Sprint(got) != "[1 2 3]" {
+		t.Errorf("Wanted nonces [1 2 3], got %v", got)
+	}
+}
+
+func Test_nonceManager_release(t *testing.T) {
+	n := newNonceManager(&fakeClient{}, common.Address{})
+	acquireNonces(t, n, 4)
+
+	// Gaps are filled lowest first before the sequence continues.
+	n.release(2)
+	n.release(1)
+	n.release(1)
+	if got := acquireNonces(t, n, 3); fmt.Sprint(got) != "[1 2 4]" {
+		t.Errorf("Wanted nonces [1 2 4], got %v", got)
+	}
+
+	// Nonces at the end of the sequence rewind it.
+	n.release(3)
+	n.release(4)
+	if n.next != 3 || len(n.reclaimed) != 0 {
+		t.Errorf("Wanted sequence rewound to 3, got next %d and reclaimed %v", n.next, n.reclaimed)
+	}
+
+	// Nonces never handed out are ignored.
+	n.release(7)
+	if got := acquireNonces(t, n, 1); got[0] != 3 {
+		t.Errorf("Wanted nonce 3, got %d", got[0])
+	}
+}
+
+func Test_nonceManager_invalidate(t *testing.T) {
+	client := &fakeClient{}
+	n := newNonceManager(client, common.Address{})
+	acquireNonces(t, n, 2)
+	n.release(0)
+
+	client.sent = []*types.Transaction{
+		types.NewTx(&types.LegacyTx{Nonce: 0}),
+		types.NewTx(&types.LegacyTx{Nonce: 1}),
+		types.NewTx(&types.LegacyTx{Nonce: 2}),
+	}
+	n.invalidate()
+	if got := acquireNonces(t, n, 1); got[0] != 3 {
+		t.Errorf("Wanted nonce 3 after resync, got %d", got[0])
+	}
+	// Nonces handed out before the resync are no longer reclaimed.
+	n.release(1)
+	if got := acquireNonces(t, n, 1); got[0] != 4 {
+		t.Errorf("Wanted nonce 4, got %d", got[0])
+	}
+}
+
+func Test_isNonceError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{err: nil, want: false},
+		{err: errors.New("insufficient funds for gas * price + value"), want: false},
+		{err: core.ErrNonceTooLow, want: true},
+		{err: fmt.Errorf("could not send tx: %w", core.ErrNonceTooHigh), want: true},
+		{err: errors.New("nonce too low"), want: true},
+	}
+	for _, tt := range tests {
+		if got := isNonceError(tt.err); got != tt.want {
+			t.Errorf("isNonceError(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
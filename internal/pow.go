@@ -0,0 +1,169 @@
+package internal
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+const (
+	maxPowDifficulty = 64
+	powSaltLength    = 16
+	// Wallet address, expiry, difficulty and salt.
+	powPayloadLength = common.AddressLength + 8 + 1 + powSaltLength
+)
+
+// Proof-of-work challenger issues challenges which let the faucet verify
+// requests without reaching a third-party captcha service. Challenges are
+// stateless: they are bound to a wallet address and expiry and signed with a
+// secret key, so any replica sharing the key can verify them. The difficulty
+// rises by a bit for every doubling of the challenges issued per minute over
+// the target rate.
+type powChallenger struct {
+	key             []byte
+	difficulty      uint8
+	maxDifficulty   uint8
+	targetPerMinute int
+	ttl             time.Duration
+	mutex           sync.Mutex
+	minute          int64
+	issued          int
+	issuedLast      int
+}
+
+func newPowChallenger(cfg *Config) (*powChallenger, error) {
+	if cfg.PowDifficulty < 0 || cfg.PowDifficulty > maxPowDifficulty {
+		return nil, fmt.Errorf("invalid proof-of-work difficulty %d", cfg.PowDifficulty)
+	}
+	maxDifficulty := cfg.PowMaxDifficulty
+	if maxDifficulty < cfg.PowDifficulty {
+		maxDifficulty = cfg.PowDifficulty
+	}
+	if maxDifficulty > maxPowDifficulty {
+		return nil, fmt.Errorf("invalid max proof-of-work difficulty %d", cfg.PowMaxDifficulty)
+	}
+	if cfg.PowChallengeTTL <= 0 {
+		return nil, fmt.Errorf("invalid proof-of-work challenge ttl %v", cfg.PowChallengeTTL)
+	}
+	key := []byte(cfg.PowSecret)
+	if len(key) == 0 {
+		log.Warn("No proof-of-work secret configured, challenges will not survive restarts")
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, fmt.Errorf("could not generate proof-of-work secret: %w", err)
+		}
+	}
+	return &powChallenger{
+		key:             key,
+		difficulty:      uint8(cfg.PowDifficulty),
+		maxDifficulty:   uint8(maxDifficulty),
+		targetPerMinute: cfg.PowTargetPerMinute,
+		ttl:             cfg.PowChallengeTTL,
+	}, nil
+}
+
+// Issues a challenge for the wallet address at the current difficulty.
+func (p *powChallenger) issue(walletAddress common.Address, now time.Time) (string, uint8, time.Time, error) {
+	p.mutex.Lock()
+	difficulty := p.currentDifficulty(now)
+	p.issued++
+	p.mutex.Unlock()
+
+	expiresAt := now.Add(p.ttl)
+	payload := make([]byte, 0, powPayloadLength+sha256.Size)
+	payload = append(payload, walletAddress.Bytes()...)
+	payload = append(payload, make([]byte, 8)...)
+	binary.BigEndian.PutUint64(payload[common.AddressLength:], uint64(expiresAt.Unix()))
+	payload = append(payload, difficulty)
+	salt := make([]byte, powSaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", 0, time.Time{}, fmt.Errorf("could not generate challenge salt: %w", err)
+	}
+	payload = append(payload, salt...)
+	challenge := append(payload, p.sign(payload)...)
+	return base64.RawURLEncoding.EncodeToString(challenge), difficulty, time.Unix(expiresAt.Unix(), 0), nil
+}
+
+// Verifies the nonce solves an unexpired challenge issued for the wallet address.
+func (p *powChallenger) verify(challenge string, nonce uint64, walletAddress common.Address, now time.Time) error {
+	raw, err := base64.RawURLEncoding.DecodeString(challenge)
+	if err != nil || len(raw) != powPayloadLength+sha256.Size {
+		return errors.New("malformed proof-of-work challenge")
+	}
+	payload, mac := raw[:powPayloadLength], raw[powPayloadLength:]
+	if !hmac.Equal(mac, p.sign(payload)) {
+		return errors.New("invalid proof-of-work challenge signature")
+	}
+	if common.BytesToAddress(payload[:common.AddressLength]) != walletAddress {
+		return fmt.Errorf("proof-of-work challenge was not issued for %s", walletAddress.Hex())
+	}
+	expiresAt := time.Unix(int64(binary.BigEndian.Uint64(payload[common.AddressLength:])), 0)
+	if !now.Before(expiresAt) {
+		return errors.New("proof-of-work challenge expired")
+	}
+	difficulty := int(payload[common.AddressLength+8])
+	if got := leadingZeroBits(powHash(challenge, nonce)); got < difficulty {
+		return fmt.Errorf("proof-of-work has %d leading zero bits, wanted %d", got, difficulty)
+	}
+	return nil
+}
+
+// Difficulty of challenges issued now based on the rate of challenges
+// issued over the last minute. Requires the lock.
+func (p *powChallenger) currentDifficulty(now time.Time) uint8 {
+	minute := now.Unix() / 60
+	if minute != p.minute {
+		p.issuedLast = 0
+		if minute == p.minute+1 {
+			p.issuedLast = p.issued
+		}
+		p.issued = 0
+		p.minute = minute
+	}
+	difficulty := p.difficulty
+	if p.targetPerMinute <= 0 {
+		return difficulty
+	}
+	// Weigh the previous minute by how much of it is still within the last minute.
+	elapsed := float64(now.Unix()%60) / 60
+	rate := float64(p.issuedLast)*(1-elapsed) + float64(p.issued)
+	for ; rate > float64(p.targetPerMinute) && difficulty < p.maxDifficulty; rate /= 2 {
+		difficulty++
+	}
+	return difficulty
+}
+
+func (p *powChallenger) sign(payload []byte) []byte {
+	mac := hmac.New(sha256.New, p.key)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+func powHash(challenge string, nonce uint64) []byte {
+	h := sha256.New()
+	h.Write([]byte(challenge))
+	var enc [8]byte
+	binary.BigEndian.PutUint64(enc[:], nonce)
+	h.Write(enc[:])
+	return h.Sum(nil)
+}
+
+func leadingZeroBits(hash []byte) int {
+	n := 0
+	for _, b := range hash {
+		if b != 0 {
+			return n + bits.LeadingZeros8(b)
+		}
+		n += 8
+	}
+	return n
+}
@@ -0,0 +1,111 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func newTestPowChallenger(t *testing.T, difficulty, maxDifficulty, targetPerMinute int) *powChallenger {
+	t.Helper()
+	p, err := newPowChallenger(&Config{
+		PowSecret:          "secret",
+		PowDifficulty:      difficulty,
+		PowMaxDifficulty:   maxDifficulty,
+		PowTargetPerMinute: targetPerMinute,
+		PowChallengeTTL:    time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func solvePow(challenge string, difficulty uint8) uint64 {
+	nonce := uint64(0)
+	for leadingZeroBits(powHash(challenge, nonce)) < int(difficulty) {
+		nonce++
+	}
+	return nonce
+}
+
+func Test_powChallenger_verify(t *testing.T) {
+	p := newTestPowChallenger(t, 8, 8, 0)
+	walletAddress := common.HexToAddress("0x0101010101010101010101010101010101010101")
+	now := time.Now()
+	challenge, difficulty, expiresAt, err := p.issue(walletAddress, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if difficulty != 8 {
+		t.Errorf("Wanted difficulty 8, got %d", difficulty)
+	}
+	nonce := solvePow(challenge, difficulty)
+	if err := p.verify(challenge, nonce, walletAddress, now); err != nil {
+		t.Fatalf("Wanted solved challenge to verify, got %v", err)
+	}
+
+	unsolved := nonce
+	for leadingZeroBits(powHash(challenge, unsolved)) >= int(difficulty) {
+		unsolved++
+	}
+	tampered := []byte(challenge)
+	tampered[0] ^= 1
+	other := newTestPowChallenger(t, 8, 8, 0)
+	other.key = []byte("other secret")
+	tests := []struct {
+		name          string
+		p             *powChallenger
+		challenge     string
+		nonce         uint64
+		walletAddress common.Address
+		now           time.Time
+	}{
+		{"insufficient_work", p, challenge, unsolved, walletAddress, now},
+		{"other_address", p, challenge, nonce, common.HexToAddress("0x0202020202020202020202020202020202020202"), now},
+		{"expired", p, challenge, nonce, walletAddress, expiresAt},
+		{"tampered", p, string(tampered), nonce, walletAddress, now},
+		{"malformed", p, "not a challenge", nonce, walletAddress, now},
+		{"other_secret", other, challenge, nonce, walletAddress, now},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.p.verify(tt.challenge, tt.nonce, tt.walletAddress, tt.now); err == nil {
+				t.Error("Wanted verification to fail")
+			}
+		})
+	}
+}
+
+func Test_powChallenger_difficultyRisesUnderLoad(t *testing.T) {
+	p := newTestPowChallenger(t, 8, 10, 10)
+	walletAddress := common.HexToAddress("0x0101010101010101010101010101010101010101")
+	now := time.Unix(6000, 0)
+	issue := func(now time.Time) uint8 {
+		_, difficulty, _, err := p.issue(walletAddress, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return difficulty
+	}
+	// Challenges are issued at the base difficulty until the rate of those
+	// issued before exceeds the target.
+	for i := 0; i <= 10; i++ {
+		if d := issue(now); d != 8 {
+			t.Fatalf("Wanted base difficulty below the target rate, got %d", d)
+		}
+	}
+	if d := issue(now); d != 9 {
+		t.Errorf("Wanted difficulty 9 above the target rate, got %d", d)
+	}
+	for i := 0; i < 100; i++ {
+		issue(now)
+	}
+	if d := issue(now); d != 10 {
+		t.Errorf("Wanted difficulty capped at 10, got %d", d)
+	}
+	if d := issue(now.Add(2 * time.Minute)); d != 8 {
+		t.Errorf("Wanted difficulty to drop back once the load passed, got %d", d)
+	}
+}
@@ -2,76 +2,212 @@ package internal
 
 import (
 	"context"
+	"fmt"
 	"sync"
 	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	memoryRateLimiterBackend = "memory"
+	boltRateLimiterBackend   = "bolt"
+	redisRateLimiterBackend  = "redis"
 )
 
+// Rate limiters atomically check and reserve a slot for a funding request
+// before its transaction is sent. The reservation counts against the limits
+// until it is either committed once funding succeeded, or released if it failed,
+// so parallel requests for the same address or ip cannot all pass the check.
 type rateLimiter interface {
 	refreshLimits(ctx context.Context)
-	shouldAllowRequest(ipAddress, ethAddress string) bool
-	markAsFunded(ipAddress, ethAddress string)
+	reserve(ipAddress, ethAddress string) (*reservation, error)
+	commit(r *reservation)
+	release(r *reservation)
+}
+
+// A slot held by a funding request in the rate limiter.
+type reservation struct {
+	ipAddress  string
+	ethAddress string
+	entries    []windowEntry
+}
+
+const (
+	addressCooldown       = "ADDRESS_COOLDOWN"
+	ipLimitPerAddress     = "IP_LIMIT_PER_ADDRESS"
+	addressLimitPerIP     = "ADDRESS_LIMIT_PER_IP"
+	addressLimitPerSubnet = "ADDRESS_LIMIT_PER_SUBNET"
+)
+
+// Returned by a rate limiter when a request should be denied, explaining
+// which limit was hit and when it resets. A zero reset time means the
+// limiter cannot tell when the request would be allowed again.
+type rateLimitError struct {
+	limit   string
+	reason  string
+	resetAt time.Time
+}
+
+func (e *rateLimitError) Error() string {
+	if e.resetAt.IsZero() {
+		return e.reason
+	}
+	return fmt.Sprintf("%s, eligible again at %s", e.reason, e.resetAt.UTC().Format(time.RFC3339))
+}
+
+// Converts the error into a gRPC status explaining the denial.
+func (e *rateLimitError) grpcStatus() *status.Status {
+	return deniedStatus(codes.PermissionDenied, fmt.Sprintf("Funded too recently: %v", e), e.limit, e.resetAt)
+}
+
+func addressCooldownError(ethAddress string, eligibleAt time.Time) error {
+	return &rateLimitError{
+		limit:   addressCooldown,
+		reason:  fmt.Sprintf("address %s funded too recently", ethAddress),
+		resetAt: eligibleAt,
+	}
+}
+
+// Initializes the rate limiter backend selected in the server configuration.
+func newRateLimiter(cfg *Config) (rateLimiter, error) {
+	if cfg.Ipv4PrefixLength < 0 || cfg.Ipv4PrefixLength > 32 {
+		return nil, fmt.Errorf("invalid ipv4 prefix length %d", cfg.Ipv4PrefixLength)
+	}
+	if cfg.Ipv6PrefixLength < 0 || cfg.Ipv6PrefixLength > 128 {
+		return nil, fmt.Errorf("invalid ipv6 prefix length %d", cfg.Ipv6PrefixLength)
+	}
+	limits := newRateLimits(cfg)
+	switch cfg.RateLimiter {
+	case "", memoryRateLimiterBackend:
+		return newSimpleRateLimiter(limits), nil
+	case boltRateLimiterBackend:
+		return newBoltRateLimiter(cfg.RateLimiterDBPath, limits)
+	case redisRateLimiterBackend:
+		return newRedisRateLimiter(cfg.RedisURL, limits)
+	default:
+		return nil, fmt.Errorf("unknown rate limiter backend %q", cfg.RateLimiter)
+	}
+}
+
+// Initializes a rate limiter enforcing its own scoped limits on the backend of
+// the faucet's rate limiter, sharing its database or redis connection.
+func newScopedRateLimiter(base rateLimiter, limits rateLimits) (rateLimiter, error) {
+	switch b := base.(type) {
+	case *boltRateLimiter:
+		return openBoltRateLimiter(b.db, limits)
+	case *redisRateLimiter:
+		return &redisRateLimiter{client: b.client, limits: limits}, nil
+	default:
+		return newSimpleRateLimiter(limits), nil
+	}
 }
 
-// Simple rate limiter uses a basic strategy of keeping ip addresses
-// in memory and limiting requests to a max limit of ip addresses per
-// ETH address requesting faucet funds.
+// Simple rate limiter uses a basic strategy of keeping the members seen for
+// each window policy key and the address cooldowns in memory, pruning them
+// once they expire.
 type simpleRateLimiter struct {
-	mutex                sync.RWMutex
-	ipLimitPerAddress    int
-	fundedAddresses      map[string]bool
-	ipCounter            map[string]int
+	mutex                sync.Mutex
+	limits               rateLimits
+	fundedAddresses      map[string]time.Time
+	seen                 map[string]map[string]time.Time
 	limitRefreshInterval time.Duration
 }
 
-func newSimpleRateLimiter(ipLimitPerAddress int) *simpleRateLimiter {
+func newSimpleRateLimiter(limits rateLimits) *simpleRateLimiter {
 	return &simpleRateLimiter{
-		ipLimitPerAddress:    ipLimitPerAddress,
-		fundedAddresses:      make(map[string]bool),
-		ipCounter:            make(map[string]int),
-		limitRefreshInterval: time.Hour * 4, /* Reset limits every 4 hours */
+		limits:               limits,
+		fundedAddresses:      make(map[string]time.Time),
+		seen:                 make(map[string]map[string]time.Time),
+		limitRefreshInterval: time.Hour, /* Prune expired limits every hour */
 	}
 }
 
-func (s *simpleRateLimiter) shouldAllowRequest(ipAddress, ethAddress string) bool {
-	s.mutex.RLock()
-	exceedPeerLimit := s.ipCounter[ipAddress] >= s.ipLimitPerAddress
-	funded := s.fundedAddresses[ethAddress]
-	s.mutex.RUnlock()
-	if exceedPeerLimit {
-		log.WithField(
-			"ipAddress", ipAddress,
-		).Warn("IP trying to get funding despite over request limit")
+func (s *simpleRateLimiter) reserve(ipAddress, ethAddress string) (*reservation, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := time.Now()
+	entries := s.limits.entries(ipAddress, ethAddress)
+	seen := make([]map[string]time.Time, len(entries))
+	for i, e := range entries {
+		seen[i] = s.seen[e.policy+":"+e.key]
+	}
+	if err := s.limits.check(ipAddress, ethAddress, entries, seen, s.fundedAddresses[ethAddress], now); err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		k := e.policy + ":" + e.key
+		if s.seen[k] == nil {
+			s.seen[k] = make(map[string]time.Time)
+		}
+		s.seen[k][e.member] = now
 	}
-	return !(funded || exceedPeerLimit)
+	s.fundedAddresses[ethAddress] = now.Add(s.limits.addressCooldown)
+	return &reservation{ipAddress: ipAddress, ethAddress: ethAddress, entries: entries}, nil
 }
 
-func (s *simpleRateLimiter) markAsFunded(ipAddress, ethAddress string) {
+// Starts the address cooldown from the moment funding succeeded.
+func (s *simpleRateLimiter) commit(r *reservation) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
-	s.ipCounter[ipAddress]++
-	s.fundedAddresses[ethAddress] = true
+	s.fundedAddresses[r.ethAddress] = time.Now().Add(s.limits.addressCooldown)
 }
 
-// Reduce the counter for each ip every few hours.
+func (s *simpleRateLimiter) release(r *reservation) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, e := range r.entries {
+		members := s.seen[e.policy+":"+e.key]
+		if members == nil {
+			continue
+		}
+		if e.previous.IsZero() {
+			delete(members, e.member)
+		} else {
+			members[e.member] = e.previous
+		}
+	}
+	delete(s.fundedAddresses, r.ethAddress)
+}
+
+// Prune members which left the limit window and addresses whose cooldown
+// expired every so often.
 func (s *simpleRateLimiter) refreshLimits(ctx context.Context) {
 	ticker := time.NewTicker(s.limitRefreshInterval)
 	defer ticker.Stop()
 	for {
 		select {
-		case <-ticker.C:
+		case now := <-ticker.C:
 			s.mutex.Lock()
 			log.WithField(
-				"numIPs", len(s.ipCounter),
-			).Info("Decreasing requests counter for all recorded IP addresses")
-			for ip, ctr := range s.ipCounter {
-				if ctr == 0 {
-					continue
-				}
-				s.ipCounter[ip] = ctr - 1
-			}
+				"numKeys", len(s.seen),
+			).Info("Pruning expired rate limits")
+			s.pruneExpired(now)
 			s.mutex.Unlock()
 		case <-ctx.Done():
 			return
 		}
 	}
 }
+
+// Evicts every member seen before the limit window and every address whose
+// cooldown expired. Requires the lock.
+func (s *simpleRateLimiter) pruneExpired(now time.Time) {
+	windowStart := now.Add(-s.limits.window)
+	for key, members := range s.seen {
+		for member, lastSeen := range members {
+			if !lastSeen.After(windowStart) {
+				delete(members, member)
+			}
+		}
+		if len(members) == 0 {
+			delete(s.seen, key)
+		}
+	}
+	for addr, eligibleAt := range s.fundedAddresses {
+		if !now.Before(eligibleAt) {
+			delete(s.fundedAddresses, addr)
+		}
+	}
+}
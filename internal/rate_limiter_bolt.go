@@ -0,0 +1,239 @@
+package internal
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var fundedAddressesBucket = []byte("funded-addresses")
+
+// Bolt rate limiter implements the same strategy as the simple rate limiter,
+// but persists address cooldowns and the members seen for each window policy
+// key to an embedded bolt database so limits survive restarts of the faucet.
+// Every window policy gets its own bucket holding a nested bucket per key.
+type boltRateLimiter struct {
+	db                   *bolt.DB
+	limits               rateLimits
+	limitRefreshInterval time.Duration
+}
+
+func newBoltRateLimiter(dbPath string, limits rateLimits) (*boltRateLimiter, error) {
+	db, err := bolt.Open(dbPath, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("could not open rate limiter db %s: %w", dbPath, err)
+	}
+	b, err := openBoltRateLimiter(db, limits)
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+// Creates the buckets of the limits in the database. Scoped limits get buckets
+// of their own, so they are pruned with their own window.
+func openBoltRateLimiter(db *bolt.DB, limits rateLimits) (*boltRateLimiter, error) {
+	b := &boltRateLimiter{
+		db:                   db,
+		limits:               limits,
+		limitRefreshInterval: time.Hour, /* Prune expired limits every hour */
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(b.bucket(fundedAddressesBucket)); err != nil {
+			return err
+		}
+		for _, p := range limits.policies {
+			if _, err := tx.CreateBucketIfNotExists(b.bucket([]byte(p.reason))); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("could not initialize rate limiter db: %w", err)
+	}
+	return b, nil
+}
+
+// Name of the bucket within the scope of the limits.
+func (b *boltRateLimiter) bucket(name []byte) []byte {
+	if b.limits.scope == "" {
+		return name
+	}
+	return append([]byte(b.limits.scope+":"), name...)
+}
+
+func (b *boltRateLimiter) reserve(ipAddress, ethAddress string) (*reservation, error) {
+	entries := b.limits.entries(ipAddress, ethAddress)
+	var limitErr error
+	if err := b.db.Update(func(tx *bolt.Tx) error {
+		now := time.Now()
+		addresses := tx.Bucket(b.bucket(fundedAddressesBucket))
+		seen := make([]map[string]time.Time, len(entries))
+		for i, e := range entries {
+			members, err := readMembers(tx.Bucket(b.bucket([]byte(e.policy))).Bucket([]byte(e.key)))
+			if err != nil {
+				return err
+			}
+			seen[i] = members
+		}
+		eligibleAt := decodeTime(addresses.Get([]byte(ethAddress)))
+		if limitErr = b.limits.check(ipAddress, ethAddress, entries, seen, eligibleAt, now); limitErr != nil {
+			return nil
+		}
+		for _, e := range entries {
+			members, err := tx.Bucket(b.bucket([]byte(e.policy))).CreateBucketIfNotExists([]byte(e.key))
+			if err != nil {
+				return err
+			}
+			if err := members.Put([]byte(e.member), encodeTime(now)); err != nil {
+				return err
+			}
+		}
+		return addresses.Put([]byte(ethAddress), encodeTime(now.Add(b.limits.addressCooldown)))
+	}); err != nil {
+		return nil, fmt.Errorf("could not reserve rate limits: %w", err)
+	}
+	if limitErr != nil {
+		return nil, limitErr
+	}
+	return &reservation{ipAddress: ipAddress, ethAddress: ethAddress, entries: entries}, nil
+}
+
+// Starts the address cooldown from the moment funding succeeded.
+func (b *boltRateLimiter) commit(r *reservation) {
+	eligibleAt := time.Now().Add(b.limits.addressCooldown)
+	if err := b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(b.bucket(fundedAddressesBucket)).Put([]byte(r.ethAddress), encodeTime(eligibleAt))
+	}); err != nil {
+		log.WithError(err).Error("Could not persist funded address")
+	}
+}
+
+func (b *boltRateLimiter) release(r *reservation) {
+	if err := b.db.Update(func(tx *bolt.Tx) error {
+		for _, e := range r.entries {
+			members := tx.Bucket(b.bucket([]byte(e.policy))).Bucket([]byte(e.key))
+			if members == nil {
+				continue
+			}
+			var err error
+			if e.previous.IsZero() {
+				err = members.Delete([]byte(e.member))
+			} else {
+				err = members.Put([]byte(e.member), encodeTime(e.previous))
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(b.bucket(fundedAddressesBucket)).Delete([]byte(r.ethAddress))
+	}); err != nil {
+		log.WithError(err).Error("Could not release rate limit reservation")
+	}
+}
+
+// Prune members which left the limit window and addresses whose cooldown
+// expired every so often.
+func (b *boltRateLimiter) refreshLimits(ctx context.Context) {
+	ticker := time.NewTicker(b.limitRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			log.Info("Pruning expired rate limits")
+			if err := b.pruneExpired(now); err != nil {
+				log.WithError(err).Error("Could not prune expired rate limits")
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Close the underlying database.
+func (b *boltRateLimiter) Close() error {
+	return b.db.Close()
+}
+
+func (b *boltRateLimiter) pruneExpired(now time.Time) error {
+	windowStart := now.Add(-b.limits.window)
+	return b.db.Update(func(tx *bolt.Tx) error {
+		for _, p := range b.limits.policies {
+			keys := tx.Bucket(b.bucket([]byte(p.reason)))
+			var emptyKeys [][]byte
+			if err := keys.ForEach(func(key, _ []byte) error {
+				members := keys.Bucket(key)
+				if members == nil {
+					return nil
+				}
+				if err := deleteWhere(members, func(lastSeen time.Time) bool {
+					return !lastSeen.After(windowStart)
+				}); err != nil {
+					return err
+				}
+				if first, _ := members.Cursor().First(); first == nil {
+					emptyKeys = append(emptyKeys, key)
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+			for _, key := range emptyKeys {
+				if err := keys.DeleteBucket(key); err != nil {
+					return err
+				}
+			}
+		}
+		return deleteWhere(tx.Bucket(b.bucket(fundedAddressesBucket)), func(eligibleAt time.Time) bool {
+			return !now.Before(eligibleAt)
+		})
+	})
+}
+
+func readMembers(members *bolt.Bucket) (map[string]time.Time, error) {
+	seen := make(map[string]time.Time)
+	if members == nil {
+		return seen, nil
+	}
+	err := members.ForEach(func(member, enc []byte) error {
+		seen[string(member)] = decodeTime(enc)
+		return nil
+	})
+	return seen, err
+}
+
+// Deletes every key in the bucket whose encoded time matches.
+func deleteWhere(bucket *bolt.Bucket, expired func(time.Time) bool) error {
+	var keys [][]byte
+	if err := bucket.ForEach(func(key, enc []byte) error {
+		if enc != nil && expired(decodeTime(enc)) {
+			keys = append(keys, key)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := bucket.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func encodeTime(t time.Time) []byte {
+	enc := make([]byte, 8)
+	binary.BigEndian.PutUint64(enc, uint64(t.UnixNano()))
+	return enc
+}
+
+func decodeTime(enc []byte) time.Time {
+	if len(enc) != 8 {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(enc)))
+}
@@ -0,0 +1,71 @@
+package internal
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func Test_boltRateLimiter_survivesRestart(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "faucet.db")
+	limits := testRateLimits(1, 1, time.Hour)
+	ethAddress := "0x0101"
+	fakeIP := "192.0.0.1"
+
+	rl, err := newBoltRateLimiter(dbPath, limits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fund(t, rl, fakeIP, ethAddress)
+	if err := rl.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	rl, err = newBoltRateLimiter(dbPath, limits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := rl.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	if err := tryReserve(rl, fakeIP, "0x0202"); err == nil {
+		t.Error("Addresses seen for an ip should survive a restart")
+	}
+	if err := tryReserve(rl, "192.0.0.2", ethAddress); err == nil {
+		t.Error("Address cooldown should survive a restart")
+	}
+}
+
+func Test_boltRateLimiter_pruneExpired(t *testing.T) {
+	rl, err := newBoltRateLimiter(filepath.Join(t.TempDir(), "faucet.db"), testRateLimits(1, 1, time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := rl.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	fund(t, rl, "192.0.0.1", "0x0101")
+
+	if err := rl.pruneExpired(time.Now().Add(25 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := rl.db.View(func(tx *bolt.Tx) error {
+		if k, _ := tx.Bucket(fundedAddressesBucket).Cursor().First(); k != nil {
+			t.Errorf("Wanted cooldowns to be pruned, found %s", k)
+		}
+		for _, p := range rl.limits.policies {
+			if k, _ := tx.Bucket([]byte(p.reason)).Cursor().First(); k != nil {
+				t.Errorf("Wanted %s keys to be pruned, found %s", p.reason, k)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,179 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	redisFundedAddressPrefix = "faucet:funded-address:"
+	redisKeyPrefix           = "faucet:"
+	// Optimistic reservations retry when another replica modified the same keys.
+	maxReserveAttempts = 10
+)
+
+// Redis rate limiter implements the same strategy as the simple rate limiter,
+// but keeps address cooldowns and the members seen for each window policy key
+// in a shared redis instance so several faucet replicas enforce a single set
+// of limits. Cooldowns are stored as keys which redis expires once the address
+// is eligible again, and members as sorted sets scored by when they were seen
+// which expire after the limit window.
+type redisRateLimiter struct {
+	client redis.UniversalClient
+	limits rateLimits
+}
+
+func newRedisRateLimiter(redisURL string, limits rateLimits) (*redisRateLimiter, error) {
+	opts, err := redis.ParseURL(redisURL)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse redis url: %w", err)
+	}
+	client := redis.NewClient(opts)
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		_ = client.Close()
+		return nil, fmt.Errorf("could not reach redis at %s: %w", opts.Addr, err)
+	}
+	return &redisRateLimiter{
+		client: client,
+		limits: limits,
+	}, nil
+}
+
+func (r *redisRateLimiter) reserve(ipAddress, ethAddress string) (*reservation, error) {
+	ctx := context.Background()
+	entries := r.limits.entries(ipAddress, ethAddress)
+	keys := make([]string, 0, len(entries)+1)
+	for _, e := range entries {
+		keys = append(keys, r.entryKey(e))
+	}
+	addressKey := r.addressKey(ethAddress)
+	keys = append(keys, addressKey)
+
+	var limitErr error
+	reserveTx := func(tx *redis.Tx) error {
+		// Members seen on an attempt which failed may have changed since, so
+		// every attempt records their previous values afresh for the release.
+		entries = r.limits.entries(ipAddress, ethAddress)
+		now := time.Now()
+		windowStart := strconv.FormatInt(redisScore(now.Add(-r.limits.window)), 10)
+		seen := make([]map[string]time.Time, len(entries))
+		for i, e := range entries {
+			members, err := tx.ZRangeByScoreWithScores(ctx, r.entryKey(e), &redis.ZRangeBy{
+				Min: "(" + windowStart,
+				Max: "+inf",
+			}).Result()
+			if err != nil {
+				return err
+			}
+			seen[i] = make(map[string]time.Time, len(members))
+			for _, m := range members {
+				seen[i][m.Member.(string)] = time.Unix(0, int64(m.Score)*int64(time.Millisecond))
+			}
+		}
+		// PTTL reports a negative duration for keys which do not exist.
+		var eligibleAt time.Time
+		remaining, err := tx.PTTL(ctx, addressKey).Result()
+		if err != nil {
+			return err
+		}
+		if remaining > 0 {
+			eligibleAt = now.Add(remaining)
+		}
+		if limitErr = r.limits.check(ipAddress, ethAddress, entries, seen, eligibleAt, now); limitErr != nil {
+			return nil
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, e := range entries {
+				key := r.entryKey(e)
+				pipe.ZAdd(ctx, key, &redis.Z{Score: float64(redisScore(now)), Member: e.member})
+				pipe.ZRemRangeByScore(ctx, key, "-inf", windowStart)
+				pipe.PExpire(ctx, key, r.limits.window)
+			}
+			if r.limits.addressCooldown > 0 {
+				pipe.Set(ctx, addressKey, now.Add(r.limits.addressCooldown).UnixNano(), r.limits.addressCooldown)
+			}
+			return nil
+		})
+		return err
+	}
+	for i := 0; i < maxReserveAttempts; i++ {
+		err := r.client.Watch(ctx, reserveTx, keys...)
+		if errors.Is(err, redis.TxFailedErr) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not reserve rate limits: %w", err)
+		}
+		if limitErr != nil {
+			return nil, limitErr
+		}
+		return &reservation{ipAddress: ipAddress, ethAddress: ethAddress, entries: entries}, nil
+	}
+	return nil, errors.New("could not reserve rate limits: too much contention")
+}
+
+// Starts the address cooldown from the moment funding succeeded.
+func (r *redisRateLimiter) commit(res *reservation) {
+	if r.limits.addressCooldown <= 0 {
+		return
+	}
+	ctx := context.Background()
+	eligibleAt := time.Now().Add(r.limits.addressCooldown)
+	if err := r.client.Set(ctx, r.addressKey(res.ethAddress), eligibleAt.UnixNano(), r.limits.addressCooldown).Err(); err != nil {
+		log.WithError(err).Error("Could not persist funded address")
+	}
+}
+
+func (r *redisRateLimiter) release(res *reservation) {
+	ctx := context.Background()
+	if _, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, e := range res.entries {
+			if e.previous.IsZero() {
+				pipe.ZRem(ctx, r.entryKey(e), e.member)
+			} else {
+				pipe.ZAdd(ctx, r.entryKey(e), &redis.Z{Score: float64(redisScore(e.previous)), Member: e.member})
+			}
+		}
+		pipe.Del(ctx, r.addressKey(res.ethAddress))
+		return nil
+	}); err != nil {
+		log.WithError(err).Error("Could not release rate limit reservation")
+	}
+}
+
+// Redis expires limits on its own, so there is nothing to refresh.
+func (r *redisRateLimiter) refreshLimits(_ context.Context) {}
+
+// Close the connection to redis.
+func (r *redisRateLimiter) Close() error {
+	return r.client.Close()
+}
+
+// Keys within the scope of the limits get the scope ahead of the address or
+// entry key, so they are never confused with the keys of other scopes.
+func (r *redisRateLimiter) addressKey(ethAddress string) string {
+	return redisFundedAddressPrefix + r.scoped(ethAddress)
+}
+
+func (r *redisRateLimiter) entryKey(e windowEntry) string {
+	return redisKeyPrefix + strings.ToLower(e.policy) + ":" + r.scoped(e.key)
+}
+
+func (r *redisRateLimiter) scoped(key string) string {
+	if r.limits.scope == "" {
+		return key
+	}
+	return r.limits.scope + ":" + key
+}
+
+// Sorted set members are scored by the millisecond they were seen at, which
+// keeps scores exact within float64 precision.
+func redisScore(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
@@ -0,0 +1,135 @@
+package internal
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+func runMiniredis(t *testing.T) *miniredis.Miniredis {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(mr.Close)
+	return mr
+}
+
+func newTestRedisRateLimiter(t *testing.T, mr *miniredis.Miniredis, limits rateLimits) *redisRateLimiter {
+	rl, err := newRedisRateLimiter("redis://"+mr.Addr(), limits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := rl.Close(); err != nil {
+			t.Error(err)
+		}
+	})
+	return rl
+}
+
+func Test_redisRateLimiter_sharedBetweenReplicas(t *testing.T) {
+	mr := runMiniredis(t)
+	limits := testRateLimits(2, 2, time.Hour)
+	first := newTestRedisRateLimiter(t, mr, limits)
+	second := newTestRedisRateLimiter(t, mr, limits)
+	fakeIP := "192.0.0.1"
+
+	fund(t, first, fakeIP, "0x0101")
+	if err := tryReserve(second, "192.0.0.2", "0x0101"); err == nil {
+		t.Error("Address funded by one replica should be denied by another")
+	}
+	fund(t, second, fakeIP, "0x0202")
+	if err := tryReserve(first, fakeIP, "0x0303"); err == nil {
+		t.Error("Addresses seen for an ip should be shared between replicas")
+	}
+}
+
+func Test_redisRateLimiter_limitsExpire(t *testing.T) {
+	mr := runMiniredis(t)
+	rl := newTestRedisRateLimiter(t, mr, testRateLimits(1, 1, time.Hour))
+	fund(t, rl, "192.0.0.1", "0x0101")
+	if err := tryReserve(rl, "192.0.0.2", "0x0101"); err == nil {
+		t.Fatal("Should disallow an address on cooldown")
+	}
+
+	mr.FastForward(time.Hour)
+	if err := tryReserve(rl, "192.0.0.1", "0x0101"); err != nil {
+		t.Errorf("Should allow once the address cooldown expired: %v", err)
+	}
+
+	mr.FastForward(24 * time.Hour)
+	if keys := mr.Keys(); len(keys) != 0 {
+		t.Errorf("Wanted every limit to expire after the window, found %v", keys)
+	}
+}
+
+// Hook running a conflicting write once the first reservation attempt read
+// the keys it watches, so that the attempt fails and is retried.
+type conflictingWriteHook struct {
+	write func()
+	done  bool
+}
+
+func (h *conflictingWriteHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	if !h.done && strings.EqualFold(cmd.Name(), "pttl") {
+		h.done = true
+		h.write()
+	}
+	return ctx, nil
+}
+
+func (h *conflictingWriteHook) AfterProcess(_ context.Context, _ redis.Cmder) error {
+	return nil
+}
+
+func (h *conflictingWriteHook) BeforeProcessPipeline(ctx context.Context, _ []redis.Cmder) (context.Context, error) {
+	return ctx, nil
+}
+
+func (h *conflictingWriteHook) AfterProcessPipeline(_ context.Context, _ []redis.Cmder) error {
+	return nil
+}
+
+func Test_redisRateLimiter_reserveRetriesWithFreshEntries(t *testing.T) {
+	mr := runMiniredis(t)
+	limits := testRateLimits(2, 2, 0)
+	rl := newTestRedisRateLimiter(t, mr, limits)
+	other := newTestRedisRateLimiter(t, mr, limits)
+	fakeIP := "192.0.0.1"
+	fund(t, rl, fakeIP, "0x0101")
+
+	// Another replica releases its reservation of the same ip and address
+	// while the first attempt is in flight.
+	entries := limits.entries(fakeIP, "0x0101")
+	rl.client.AddHook(&conflictingWriteHook{write: func() {
+		for _, e := range entries {
+			if err := other.client.ZRem(context.Background(), other.entryKey(e), e.member).Err(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}})
+	res, err := rl.reserve(fakeIP, "0x0101")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range res.entries {
+		if !e.previous.IsZero() {
+			t.Errorf("Wanted no previous member of %s after the conflicting release, got %v", e.policy, e.previous)
+		}
+	}
+
+	// Releasing the retried reservation must not restore the member which
+	// was released in the meantime.
+	rl.release(res)
+	for _, e := range entries {
+		if mr.Exists(rl.entryKey(e)) {
+			members, _ := mr.ZMembers(rl.entryKey(e))
+			t.Errorf("Wanted %s to hold no members after the release, got %v", e.policy, members)
+		}
+	}
+}
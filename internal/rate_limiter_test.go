@@ -1,43 +1,281 @@
 package internal
 
-import "testing"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+type rateLimiterBackend struct {
+	name string
+	new  func(t *testing.T, limits rateLimits) rateLimiter
+	// Puts an address on cooldown until the given time.
+	setEligibleAt func(t *testing.T, rl rateLimiter, ethAddress string, eligibleAt time.Time)
+}
+
+var rateLimiterBackends = []rateLimiterBackend{
+	{
+		name: memoryRateLimiterBackend,
+		new: func(t *testing.T, limits rateLimits) rateLimiter {
+			return newSimpleRateLimiter(limits)
+		},
+		setEligibleAt: func(t *testing.T, rl rateLimiter, ethAddress string, eligibleAt time.Time) {
+			rl.(*simpleRateLimiter).fundedAddresses[ethAddress] = eligibleAt
+		},
+	},
+	{
+		name: boltRateLimiterBackend,
+		new: func(t *testing.T, limits rateLimits) rateLimiter {
+			rl, err := newBoltRateLimiter(filepath.Join(t.TempDir(), "faucet.db"), limits)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() {
+				if err := rl.Close(); err != nil {
+					t.Error(err)
+				}
+			})
+			return rl
+		},
+		setEligibleAt: func(t *testing.T, rl rateLimiter, ethAddress string, eligibleAt time.Time) {
+			if err := rl.(*boltRateLimiter).db.Update(func(tx *bolt.Tx) error {
+				return tx.Bucket(fundedAddressesBucket).Put([]byte(ethAddress), encodeTime(eligibleAt))
+			}); err != nil {
+				t.Fatal(err)
+			}
+		},
+	},
+	{
+		name: redisRateLimiterBackend,
+		new: func(t *testing.T, limits rateLimits) rateLimiter {
+			return newTestRedisRateLimiter(t, runMiniredis(t), limits)
+		},
+		setEligibleAt: func(t *testing.T, rl rateLimiter, ethAddress string, eligibleAt time.Time) {
+			ctx := context.Background()
+			client := rl.(*redisRateLimiter).client
+			var err error
+			if remaining := time.Until(eligibleAt); remaining > 0 {
+				err = client.Set(ctx, redisFundedAddressPrefix+ethAddress, eligibleAt.UnixNano(), remaining).Err()
+			} else {
+				err = client.Del(ctx, redisFundedAddressPrefix+ethAddress).Err()
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		},
+	},
+}
+
+func testRateLimits(ipLimitPerAddress, addressLimitPerIP int, addressCooldown time.Duration) rateLimits {
+	return newRateLimits(&Config{
+		IpLimitPerAddress: ipLimitPerAddress,
+		AddressLimitPerIP: addressLimitPerIP,
+		Ipv4PrefixLength:  24,
+		Ipv6PrefixLength:  64,
+		LimitWindow:       24 * time.Hour,
+		AddressCooldown:   addressCooldown,
+	})
+}
+
+// Checks whether a request would be allowed without holding on to its reservation.
+func tryReserve(rl rateLimiter, ipAddress, ethAddress string) error {
+	r, err := rl.reserve(ipAddress, ethAddress)
+	if err != nil {
+		return err
+	}
+	rl.release(r)
+	return nil
+}
+
+// Reserves and commits a funding request which is expected to be allowed.
+func fund(t *testing.T, rl rateLimiter, ipAddress, ethAddress string) {
+	r, err := rl.reserve(ipAddress, ethAddress)
+	if err != nil {
+		t.Fatalf("Could not reserve funding for %s: %v", ethAddress, err)
+	}
+	rl.commit(r)
+}
+
+func requireLimit(t *testing.T, err error, limit string) *rateLimitError {
+	var limitErr *rateLimitError
+	if !errors.As(err, &limitErr) {
+		t.Fatalf("Wanted a rate limit error, got %v", err)
+	}
+	if limitErr.limit != limit {
+		t.Errorf("Wanted limit %s to be hit, got %s", limit, limitErr.limit)
+	}
+	return limitErr
+}
 
 func Test_simpleRateLimiter(t *testing.T) {
-	ipLimitPerAddress := 3
-	rl := newSimpleRateLimiter(ipLimitPerAddress)
+	for _, backend := range rateLimiterBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			testRateLimiter(t, backend)
+		})
+	}
+}
+
+func testRateLimiter(t *testing.T, backend rateLimiterBackend) {
 	ethAddress := "0x0101"
 	fakeIP := "192.0.0.1"
 
 	t.Run("first_time_request_should_allow", func(t *testing.T) {
-		if ok := rl.shouldAllowRequest(fakeIP, ethAddress); !ok {
-			t.Error("First time making request should always be allowed")
+		rl := backend.new(t, testRateLimits(3, 3, 24*time.Hour))
+		if err := tryReserve(rl, fakeIP, ethAddress); err != nil {
+			t.Errorf("First time making request should always be allowed: %v", err)
+		}
+	})
+
+	t.Run("address_on_cooldown_disallow", func(t *testing.T) {
+		rl := backend.new(t, testRateLimits(3, 3, 24*time.Hour))
+		fund(t, rl, fakeIP, ethAddress)
+		limitErr := requireLimit(t, tryReserve(rl, "192.0.0.2", ethAddress), addressCooldown)
+		eligibleAt := time.Now().Add(24 * time.Hour)
+		if d := limitErr.resetAt.Sub(eligibleAt); d < -time.Second || d > time.Second {
+			t.Errorf("Wanted address to be eligible at %v, got %v", eligibleAt, limitErr.resetAt)
+		}
+
+		backend.setEligibleAt(t, rl, ethAddress, time.Now().Add(-time.Second))
+		if err := tryReserve(rl, "192.0.0.2", ethAddress); err != nil {
+			t.Errorf("Should allow after the address cooldown expired: %v", err)
+		}
+	})
+
+	t.Run("over_ip_limit_per_address_disallow", func(t *testing.T) {
+		limit := 3
+		rl := backend.new(t, testRateLimits(limit, 3, 0))
+		for i := 0; i < limit; i++ {
+			fund(t, rl, fmt.Sprintf("192.0.0.%d", i), ethAddress)
+		}
+		requireLimit(t, tryReserve(rl, "192.0.1.1", ethAddress), ipLimitPerAddress)
+		if err := tryReserve(rl, "192.0.0.0", ethAddress); err != nil {
+			t.Errorf("Should allow an ip which already requested the address: %v", err)
+		}
+		if err := tryReserve(rl, "192.0.1.1", "0x0202"); err != nil {
+			t.Errorf("Should allow the ip to request another address: %v", err)
 		}
 	})
 
-	t.Run("funded_but_under_ip_rate_limit_disallow", func(t *testing.T) {
-		rl.fundedAddresses[ethAddress] = true
-		if ok := rl.shouldAllowRequest(fakeIP, ethAddress); ok {
-			t.Error("Should disallow after marked as funded")
+	t.Run("over_address_limit_per_ip_disallow", func(t *testing.T) {
+		limit := 3
+		rl := backend.new(t, testRateLimits(3, limit, 0))
+		for i := 0; i < limit; i++ {
+			fund(t, rl, fakeIP, fmt.Sprintf("0x%04d", i))
+		}
+		requireLimit(t, tryReserve(rl, fakeIP, ethAddress), addressLimitPerIP)
+		if err := tryReserve(rl, fakeIP, "0x0000"); err != nil {
+			t.Errorf("Should allow an address the ip already requested: %v", err)
+		}
+		if err := tryReserve(rl, "192.0.0.2", ethAddress); err != nil {
+			t.Errorf("Should allow another ip to request the address: %v", err)
+		}
+	})
+
+	t.Run("over_address_limit_per_subnet_disallow", func(t *testing.T) {
+		limits := testRateLimits(3, 3, 0)
+		limits.policies[2].limit = 2
+		rl := backend.new(t, limits)
+		fund(t, rl, "192.0.2.1", "0x0001")
+		fund(t, rl, "::ffff:192.0.2.2", "0x0002")
+		requireLimit(t, tryReserve(rl, "192.0.2.3", ethAddress), addressLimitPerSubnet)
+		if err := tryReserve(rl, "192.0.3.1", ethAddress); err != nil {
+			t.Errorf("Should allow an ip from another subnet: %v", err)
+		}
+
+		fund(t, rl, "2001:db8::1", "0x0003")
+		fund(t, rl, "2001:db8::ffff:1", "0x0004")
+		requireLimit(t, tryReserve(rl, "2001:db8::2", ethAddress), addressLimitPerSubnet)
+		if err := tryReserve(rl, "2001:db8:0:1::1", ethAddress); err != nil {
+			t.Errorf("Should allow an ip from another subnet: %v", err)
 		}
-		rl.fundedAddresses[ethAddress] = false
 	})
 
-	t.Run("over_ip_rate_limit_disallow", func(t *testing.T) {
-		for i := 0; i < ipLimitPerAddress; i++ {
-			rl.markAsFunded(fakeIP, ethAddress)
+	t.Run("disabled_limits_should_allow", func(t *testing.T) {
+		rl := backend.new(t, testRateLimits(0, 0, 0))
+		for i := 0; i < 10; i++ {
+			fund(t, rl, fakeIP, fmt.Sprintf("0x%04d", i))
+		}
+		if err := tryReserve(rl, fakeIP, ethAddress); err != nil {
+			t.Errorf("Should allow when limits are disabled: %v", err)
+		}
+	})
+
+	t.Run("reservation_held_until_released", func(t *testing.T) {
+		rl := backend.new(t, testRateLimits(1, 1, 24*time.Hour))
+		r, err := rl.reserve(fakeIP, ethAddress)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tryReserve(rl, "192.0.0.2", ethAddress); err == nil {
+			t.Error("Should disallow while another request holds the address")
+		}
+		if err := tryReserve(rl, fakeIP, "0x0202"); err == nil {
+			t.Error("Should disallow while another request holds the ip")
 		}
-		if ok := rl.shouldAllowRequest(fakeIP, ethAddress); ok {
-			t.Error("Should disallow after reaching rate limit")
+		rl.release(r)
+		if err := tryReserve(rl, "192.0.0.2", ethAddress); err != nil {
+			t.Errorf("Should allow after the reservation was released: %v", err)
+		}
+		if err := tryReserve(rl, fakeIP, "0x0202"); err != nil {
+			t.Errorf("Should allow after the reservation was released: %v", err)
 		}
 	})
+}
 
-	t.Run("reset_rate_limit_should_allow", func(t *testing.T) {
-		// Reset the limit.
-		rl.fundedAddresses[ethAddress] = false
-		rl.ipCounter[fakeIP] = 0
+func Test_rateLimits_check(t *testing.T) {
+	limits := testRateLimits(2, 2, 0)
+	now := time.Now()
+	ethAddress := "0x0101"
+	fakeIP := "192.0.0.1"
 
-		if ok := rl.shouldAllowRequest(fakeIP, ethAddress); !ok {
-			t.Error("Should allow after resetting the limits")
+	t.Run("members_outside_window_ignored", func(t *testing.T) {
+		entries := limits.entries(fakeIP, ethAddress)
+		seen := []map[string]time.Time{
+			{"192.0.0.2": now.Add(-25 * time.Hour), "192.0.0.3": now.Add(-time.Hour)},
+			{},
+			{},
+		}
+		if err := limits.check(fakeIP, ethAddress, entries, seen, time.Time{}, now); err != nil {
+			t.Errorf("Should allow when members left the window: %v", err)
 		}
 	})
+
+	t.Run("reset_when_enough_members_expire", func(t *testing.T) {
+		entries := limits.entries(fakeIP, ethAddress)
+		seen := []map[string]time.Time{
+			{},
+			{"0x0202": now.Add(-3 * time.Hour), "0x0303": now.Add(-2 * time.Hour), "0x0404": now.Add(-time.Hour)},
+			{},
+		}
+		err := limits.check(fakeIP, ethAddress, entries, seen, time.Time{}, now)
+		limitErr := requireLimit(t, err, addressLimitPerIP)
+		// Two of the three addresses have to expire to get below the limit.
+		if want := now.Add(22 * time.Hour); !limitErr.resetAt.Equal(want) {
+			t.Errorf("Wanted reset at %v, got %v", want, limitErr.resetAt)
+		}
+	})
+}
+
+func Test_simpleRateLimiter_pruneExpired(t *testing.T) {
+	rl := newSimpleRateLimiter(testRateLimits(3, 3, time.Hour))
+	fund(t, rl, "192.0.0.1", "0x0101")
+	rl.fundedAddresses["0x0202"] = time.Now().Add(-time.Second)
+
+	rl.pruneExpired(time.Now())
+	if _, ok := rl.fundedAddresses["0x0202"]; ok {
+		t.Error("Expired address should have been evicted")
+	}
+	if _, ok := rl.fundedAddresses["0x0101"]; !ok {
+		t.Error("Address still on cooldown should not be evicted")
+	}
+
+	rl.pruneExpired(time.Now().Add(25 * time.Hour))
+	if len(rl.seen) != 0 || len(rl.fundedAddresses) != 0 {
+		t.Error("Every limit should have been evicted after the window")
+	}
 }
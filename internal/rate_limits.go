@@ -0,0 +1,130 @@
+package internal
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Limits enforced by every rate limiter backend. Each funded address is put
+// on a cooldown, and every window policy bounds the number of distinct members
+// seen for a key within a sliding window.
+type rateLimits struct {
+	// Keeps the limits apart from other limits kept by the same backend, such as
+	// the limits of each token. Empty for the limits of ETH funding.
+	scope           string
+	addressCooldown time.Duration
+	window          time.Duration
+	policies        []windowPolicy
+}
+
+// Limits the number of distinct members seen for a key within the limit window,
+// such as the number of distinct ips requesting funds for an address.
+type windowPolicy struct {
+	// Reason reported in the denial of a request hitting the limit.
+	reason string
+	// Formats the denial for the limited key.
+	describe string
+	limit    int
+	// Derives the limited key and the member counted towards its limit for a request.
+	entry func(ipAddress, ethAddress string) (key, member string)
+}
+
+// A member counted towards the limit of a window policy key by a request.
+type windowEntry struct {
+	policy string
+	key    string
+	member string
+	// When the member was last seen within the window, zero if it was not.
+	previous time.Time
+}
+
+func newRateLimits(cfg *Config) rateLimits {
+	return rateLimits{
+		addressCooldown: cfg.AddressCooldown,
+		window:          cfg.LimitWindow,
+		policies: []windowPolicy{
+			{
+				reason:   ipLimitPerAddress,
+				describe: "address %s was requested from too many ips",
+				limit:    cfg.IpLimitPerAddress,
+				entry: func(ipAddress, ethAddress string) (string, string) {
+					return ethAddress, ipAddress
+				},
+			},
+			{
+				reason:   addressLimitPerIP,
+				describe: "ip %s requested funds for too many addresses",
+				limit:    cfg.AddressLimitPerIP,
+				entry: func(ipAddress, ethAddress string) (string, string) {
+					return ipAddress, ethAddress
+				},
+			},
+			{
+				reason:   addressLimitPerSubnet,
+				describe: "subnet %s requested funds for too many addresses",
+				limit:    cfg.AddressLimitPerSubnet,
+				entry: func(ipAddress, ethAddress string) (string, string) {
+					return ipSubnet(ipAddress, cfg.Ipv4PrefixLength, cfg.Ipv6PrefixLength), ethAddress
+				},
+			},
+		},
+	}
+}
+
+// Lists the entries a request counts towards, one for each window policy.
+func (l rateLimits) entries(ipAddress, ethAddress string) []windowEntry {
+	entries := make([]windowEntry, len(l.policies))
+	for i, p := range l.policies {
+		key, member := p.entry(ipAddress, ethAddress)
+		entries[i] = windowEntry{policy: p.reason, key: key, member: member}
+	}
+	return entries
+}
+
+// Checks whether a request may be funded given when its address is eligible for
+// funding again and the members seen for the key of each of its entries. Records
+// when each entry member was last seen within the window.
+func (l rateLimits) check(
+	ipAddress, ethAddress string,
+	entries []windowEntry,
+	seen []map[string]time.Time,
+	eligibleAt, now time.Time,
+) error {
+	if now.Before(eligibleAt) {
+		return addressCooldownError(ethAddress, eligibleAt)
+	}
+	windowStart := now.Add(-l.window)
+	for i, p := range l.policies {
+		var active []time.Time
+		for member, lastSeen := range seen[i] {
+			if !lastSeen.After(windowStart) {
+				continue
+			}
+			if member == entries[i].member {
+				entries[i].previous = lastSeen
+				continue
+			}
+			active = append(active, lastSeen)
+		}
+		if !entries[i].previous.IsZero() || p.limit <= 0 || len(active) < p.limit {
+			continue
+		}
+		log.WithFields(logrus.Fields{
+			"ipAddress": ipAddress,
+			"address":   ethAddress,
+			"limit":     p.reason,
+		}).Warn("Request trying to get funding despite over request limit")
+		// A new member is allowed once enough of the members seen expire
+		// from the window to get below the limit.
+		sort.Slice(active, func(a, b int) bool { return active[a].Before(active[b]) })
+		return &rateLimitError{
+			limit:   p.reason,
+			reason:  fmt.Sprintf(p.describe, entries[i].key),
+			resetAt: active[len(active)-p.limit].Add(l.window),
+		}
+	}
+	return nil
+}
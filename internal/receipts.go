@@ -0,0 +1,198 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	txDropped      = "TX_DROPPED"
+	txReverted     = "TX_REVERTED"
+	fundingTimeout = "FUNDING_TIMEOUT"
+)
+
+var (
+	// The funding transaction vanished from the node, either from its pool
+	// before it mined or from the chain after a reorg.
+	errTxDropped = errors.New("transaction dropped")
+	// The funding transaction mined with a failed receipt status.
+	errTxReverted = errors.New("transaction reverted")
+)
+
+// Returned once funding stops waiting for a broadcast transaction, because the
+// max funding wait passed or the faucet shuts down, while it may still mine.
+type waitAbortedError struct {
+	txHash common.Hash
+	err    error
+}
+
+func (e *waitAbortedError) Error() string {
+	return fmt.Sprintf("stopped waiting for tx %s: %v", e.txHash.Hex(), e.err)
+}
+
+func (e *waitAbortedError) Unwrap() error {
+	return e.err
+}
+
+// Converts a funding failure into a gRPC status, telling dropped and reverted
+// transactions apart from other errors. Funding which timed out reports the
+// hash of its pending transaction.
+func fundingFailedStatus(err error) *status.Status {
+	msg := fmt.Sprintf("Could not send goerli transaction: %v", err)
+	var abortedErr *waitAbortedError
+	if errors.As(err, &abortedErr) {
+		st := status.Newf(codes.Canceled, "Stopped waiting for transaction %s", abortedErr.txHash.Hex())
+		if errors.Is(err, context.DeadlineExceeded) {
+			st = status.Newf(codes.DeadlineExceeded, "Timed out waiting for transaction %s", abortedErr.txHash.Hex())
+		}
+		return withDetails(st, &errdetails.ErrorInfo{
+			Reason:   fundingTimeout,
+			Domain:   errorDomain,
+			Metadata: map[string]string{"txHash": abortedErr.txHash.Hex()},
+		})
+	}
+	switch {
+	case errors.Is(err, errTxDropped):
+		return deniedStatus(codes.Aborted, msg, txDropped, time.Time{})
+	case errors.Is(err, errTxReverted):
+		return deniedStatus(codes.Internal, msg, txReverted, time.Time{})
+	default:
+		return status.New(codes.Internal, msg)
+	}
+}
+
+// Waits until the transaction mined with a successful receipt and the configured
+// number of blocks, counting its own, were built on top of it. Keeps track of
+// reorgs in the meantime, waiting for the transaction to mine again if a reorg
+// put it back into the pool, and failing if it dropped out entirely. A
+// transaction pending for too long is replaced with bumped fees, after which
+// any of the broadcast versions may mine.
+func (s *Server) waitConfirmed(
+	ctx context.Context, requestID string, funder *funder, tx *types.Transaction,
+) (*types.Receipt, error) {
+	log.WithField("txHash", tx.Hash().Hex()).Info("Awaiting for tx to mine...")
+	start := time.Now()
+	sent := []*types.Transaction{tx}
+	broadcastAt := start
+	var mined *types.Receipt
+	// Node calls failing because the wait was given up report the latest
+	// broadcast transaction, which may still mine.
+	aborted := func(err error) error {
+		if ctx.Err() == nil {
+			return err
+		}
+		return &waitAbortedError{txHash: sent[len(sent)-1].Hash(), err: ctx.Err()}
+	}
+	for {
+		receipt, err := s.minedReceipt(ctx, sent)
+		switch {
+		case err == nil:
+			if receipt.Status != types.ReceiptStatusSuccessful {
+				return nil, fmt.Errorf("%w in block %d", errTxReverted, receipt.BlockNumber)
+			}
+			if mined == nil || mined.BlockHash != receipt.BlockHash {
+				mined = receipt
+				s.fundingRequests.mined(requestID, receipt.TxHash, receipt.BlockNumber.Uint64())
+				log.WithFields(logrus.Fields{
+					"timeElapsed": fmt.Sprintf("%v", time.Since(start)),
+					"txHash":      receipt.TxHash.Hex(),
+					"blockNumber": receipt.BlockNumber,
+				}).Info("Transaction mined")
+			}
+			head, err := s.client.BlockNumber(ctx)
+			if err != nil {
+				return nil, aborted(fmt.Errorf("could not get block number: %w", err))
+			}
+			if head+1 >= receipt.BlockNumber.Uint64()+uint64(s.cfg.Confirmations) {
+				return receipt, nil
+			}
+		case errors.Is(err, ethereum.NotFound):
+			latest := sent[len(sent)-1]
+			_, pending, err := s.client.TransactionByHash(ctx, latest.Hash())
+			if errors.Is(err, ethereum.NotFound) {
+				// An earlier version may have mined in the meantime, evicting
+				// the latest one from the pool.
+				if _, err := s.minedReceipt(ctx, sent); err == nil {
+					continue
+				}
+				if mined != nil {
+					return nil, fmt.Errorf("%w after a reorg removed block %d", errTxDropped, mined.BlockNumber)
+				}
+				return nil, errTxDropped
+			}
+			if err != nil {
+				return nil, aborted(fmt.Errorf("could not wait for tx to mine: %w", err))
+			}
+			if pending && mined != nil {
+				log.WithFields(logrus.Fields{
+					"txHash":      mined.TxHash.Hex(),
+					"blockNumber": mined.BlockNumber,
+				}).Warn("Transaction reorged back into the pool")
+				mined = nil
+				s.fundingRequests.broadcast(requestID, latest.Hash())
+			}
+			if pending && s.cfg.ReplaceAfter > 0 && time.Since(broadcastAt) >= s.cfg.ReplaceAfter {
+				if replacement, err := s.replaceStuckTx(ctx, funder, latest); err == nil {
+					sent = append(sent, replacement)
+					s.fundingRequests.broadcast(requestID, replacement.Hash())
+				}
+				broadcastAt = time.Now()
+			}
+		default:
+			return nil, aborted(fmt.Errorf("could not get tx receipt: %w", err))
+		}
+		select {
+		case <-time.After(s.pollInterval):
+		case <-ctx.Done():
+			return nil, aborted(ctx.Err())
+		}
+	}
+}
+
+// Receipt of whichever broadcast version of a transaction mined, or
+// ethereum.NotFound if none did yet.
+func (s *Server) minedReceipt(ctx context.Context, sent []*types.Transaction) (*types.Receipt, error) {
+	for i := len(sent) - 1; i >= 0; i-- {
+		receipt, err := s.client.TransactionReceipt(ctx, sent[i].Hash())
+		if !errors.Is(err, ethereum.NotFound) {
+			return receipt, err
+		}
+	}
+	return nil, ethereum.NotFound
+}
+
+// Rebroadcasts a stuck transaction at the same nonce with bumped fees.
+func (s *Server) replaceStuckTx(ctx context.Context, funder *funder, stuck *types.Transaction) (*types.Transaction, error) {
+	fields := logrus.Fields{
+		"txHash": stuck.Hash().Hex(),
+		"funder": funder.address.Hex(),
+		"nonce":  stuck.Nonce(),
+	}
+	replacement, err := s.newReplacementTx(ctx, stuck)
+	if err == nil {
+		replacement, err = funder.signer.signTx(ctx, replacement, big.NewInt(s.cfg.ChainId))
+	}
+	if err == nil {
+		err = s.client.SendTransaction(ctx, replacement)
+	}
+	if err != nil {
+		log.WithError(err).WithFields(fields).Warn("Could not replace stuck transaction")
+		return nil, err
+	}
+	fields["replacementTxHash"] = replacement.Hash().Hex()
+	fields["gasFeeCap"] = replacement.GasFeeCap()
+	fields["gasTipCap"] = replacement.GasTipCap()
+	log.WithFields(fields).Info("Replaced stuck transaction")
+	return replacement, nil
+}
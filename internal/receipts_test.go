@@ -0,0 +1,338 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/params"
+	faucetpb "github.com/rauljordan/eth-faucet/proto/faucet"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Ethereum client whose node loses every transaction it was sent.
+type droppingClient struct {
+	*fakeClient
+}
+
+func (c *droppingClient) SendTransaction(_ context.Context, _ *types.Transaction) error {
+	return nil
+}
+
+// Ethereum client which reorgs transactions out of the chain after their
+// receipt was fetched once, and drops them from the pool.
+type reorgingClient struct {
+	*fakeClient
+	reorged bool
+}
+
+func (c *reorgingClient) TransactionReceipt(ctx context.Context, hash common.Hash) (*types.Receipt, error) {
+	c.mutex.Lock()
+	reorged := c.reorged
+	c.reorged = true
+	c.mutex.Unlock()
+	if reorged {
+		return nil, ethereum.NotFound
+	}
+	return c.fakeClient.TransactionReceipt(ctx, hash)
+}
+
+func (c *reorgingClient) TransactionByHash(_ context.Context, _ common.Hash) (*types.Transaction, bool, error) {
+	return nil, false, ethereum.NotFound
+}
+
+// Ethereum client which drops the first transaction sent, and keeps later
+// transactions behind the nonce gap it leaves pending in the pool.
+type nonceGapClient struct {
+	*fakeClient
+	dropped bool
+	queued  map[common.Hash]bool
+}
+
+func (c *nonceGapClient) SendTransaction(ctx context.Context, tx *types.Transaction) error {
+	c.mutex.Lock()
+	if !c.dropped {
+		c.dropped = true
+		c.mutex.Unlock()
+		return nil
+	}
+	if tx.Nonce() > uint64(len(c.sent)) {
+		c.queued[tx.Hash()] = true
+		c.mutex.Unlock()
+		return nil
+	}
+	c.mutex.Unlock()
+	return c.fakeClient.SendTransaction(ctx, tx)
+}
+
+func (c *nonceGapClient) TransactionByHash(ctx context.Context, hash common.Hash) (*types.Transaction, bool, error) {
+	c.mutex.Lock()
+	queued := c.queued[hash]
+	c.mutex.Unlock()
+	if queued {
+		return nil, true, nil
+	}
+	return c.fakeClient.TransactionByHash(ctx, hash)
+}
+
+func captchaFundingRequest(ethAddress string) *faucetpb.FundingRequest {
+	return &faucetpb.FundingRequest{
+		WalletAddress:   ethAddress,
+		CaptchaResponse: captchaToken(ethAddress),
+	}
+}
+
+func TestServer_RequestFunds_waitsForConfirmations(t *testing.T) {
+	client := &fakeClient{}
+	srv := newTestServer(t, newSimpleRateLimiter(testRateLimits(5, 5, time.Hour)), client)
+	srv.cfg.Confirmations = 3
+	srv.cfg.AsyncFunding = true
+
+	ethAddress := "0x0101010101010101010101010101010101010101"
+	resp, err := srv.RequestFunds(requestContext("192.0.0.1"), captchaFundingRequest(ethAddress))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &faucetpb.FundingStatusRequest{RequestId: resp.RequestId}
+	awaitState := func(want faucetpb.FundingState) {
+		var st *faucetpb.FundingStatusResponse
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if st, err = srv.GetFundingStatus(context.Background(), req); err != nil {
+				t.Fatal(err)
+			}
+			if st.State == want {
+				return
+			}
+		}
+		t.Fatalf("Wanted state %v, got %v", want, st.State)
+	}
+
+	awaitState(faucetpb.FundingState_MINED)
+	time.Sleep(50 * time.Millisecond)
+	client.mineBlocks(1)
+	time.Sleep(50 * time.Millisecond)
+	if st, _ := srv.GetFundingStatus(context.Background(), req); st.State != faucetpb.FundingState_MINED {
+		t.Errorf("Wanted request 2 blocks deep to still be mined, got %v", st.State)
+	}
+	client.mineBlocks(1)
+	awaitState(faucetpb.FundingState_CONFIRMED)
+
+	// Only a confirmed request counts against the rate limits.
+	_, err = srv.RequestFunds(requestContext("192.0.0.1"), captchaFundingRequest(ethAddress))
+	requireDenied(t, err, addressCooldown)
+}
+
+func TestServer_RequestFunds_failedReceipt(t *testing.T) {
+	client := &fakeClient{reverted: true}
+	srv := newTestServer(t, newSimpleRateLimiter(testRateLimits(5, 5, time.Hour)), client)
+
+	ethAddress := "0x0101010101010101010101010101010101010101"
+	_, err := srv.RequestFunds(requestContext("192.0.0.1"), captchaFundingRequest(ethAddress))
+	if status.Code(err) != codes.Internal {
+		t.Errorf("Wanted code %v, got %v", codes.Internal, err)
+	}
+	requireDenied(t, err, txReverted)
+
+	// Failed requests release their rate limits.
+	client.reverted = false
+	if _, err := srv.RequestFunds(requestContext("192.0.0.1"), captchaFundingRequest(ethAddress)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServer_RequestFunds_droppedTx(t *testing.T) {
+	tests := []struct {
+		name    string
+		client  ethClient
+		wantMsg string
+	}{
+		{
+			name:   "dropped_from_pool",
+			client: &droppingClient{fakeClient: &fakeClient{}},
+		},
+		{
+			name:    "reorged_out",
+			client:  &reorgingClient{fakeClient: &fakeClient{}},
+			wantMsg: "reorg",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newTestServer(t, newSimpleRateLimiter(testRateLimits(5, 5, time.Hour)), tt.client)
+			srv.cfg.Confirmations = 2
+			ethAddress := "0x0101010101010101010101010101010101010101"
+			_, err := srv.RequestFunds(requestContext("192.0.0.1"), captchaFundingRequest(ethAddress))
+			if status.Code(err) != codes.Aborted {
+				t.Errorf("Wanted code %v, got %v", codes.Aborted, err)
+			}
+			requireDenied(t, err, txDropped)
+			if !strings.Contains(status.Convert(err).Message(), tt.wantMsg) {
+				t.Errorf("Wanted message containing %q, got %v", tt.wantMsg, err)
+			}
+		})
+	}
+}
+
+func TestServer_RequestFunds_resyncsNonceAfterDrop(t *testing.T) {
+	client := &nonceGapClient{fakeClient: &fakeClient{}, queued: make(map[common.Hash]bool)}
+	srv := newTestServer(t, newSimpleRateLimiter(testRateLimits(5, 5, time.Hour)), client)
+	srv.cfg.MaxFundingWait = time.Second
+	_, err := srv.RequestFunds(requestContext("192.0.0.1"), captchaFundingRequest("0x0101010101010101010101010101010101010101"))
+	requireDenied(t, err, txDropped)
+
+	// The next funding reuses the dropped nonce instead of waiting behind it.
+	resp, err := srv.RequestFunds(requestContext("192.0.0.1"), captchaFundingRequest("0x0202020202020202020202020202020202020202"))
+	if err != nil {
+		t.Fatalf("Wanted funding after a dropped tx to succeed: %v", err)
+	}
+	if tx := client.sent[0]; tx.Nonce() != 0 || tx.Hash().Hex() != resp.TransactionHash {
+		t.Errorf("Wanted funding to be sent with the dropped nonce 0, got nonce %d", tx.Nonce())
+	}
+}
+
+func Test_fundingFailedStatus(t *testing.T) {
+	if st := fundingFailedStatus(errors.New("connection refused")); st.Code() != codes.Internal || len(st.Details()) != 0 {
+		t.Errorf("Wanted internal error without details, got %v", st)
+	}
+}
+
+// Ethereum client which keeps transactions paying less than the min fee cap
+// pending, until a replacement at their nonce pays enough to mine.
+type congestedClient struct {
+	*fakeClient
+	minFeeCap *big.Int
+	pending   map[common.Hash]*types.Transaction
+}
+
+func (c *congestedClient) SendTransaction(ctx context.Context, tx *types.Transaction) error {
+	c.mutex.Lock()
+	if tx.GasFeeCap().Cmp(c.minFeeCap) < 0 {
+		for hash, pending := range c.pending {
+			if pending.Nonce() == tx.Nonce() {
+				delete(c.pending, hash)
+			}
+		}
+		c.pending[tx.Hash()] = tx
+		c.mutex.Unlock()
+		return nil
+	}
+	c.pending = make(map[common.Hash]*types.Transaction)
+	c.mutex.Unlock()
+	return c.fakeClient.SendTransaction(ctx, tx)
+}
+
+func (c *congestedClient) TransactionByHash(ctx context.Context, hash common.Hash) (*types.Transaction, bool, error) {
+	c.mutex.Lock()
+	tx, ok := c.pending[hash]
+	c.mutex.Unlock()
+	if ok {
+		return tx, true, nil
+	}
+	return c.fakeClient.TransactionByHash(ctx, hash)
+}
+
+func TestServer_RequestFunds_replacesStuckTx(t *testing.T) {
+	client := &congestedClient{
+		fakeClient: &fakeClient{baseFee: big.NewInt(params.GWei), gasTip: big.NewInt(params.GWei)},
+		minFeeCap:  big.NewInt(4 * params.GWei),
+		pending:    make(map[common.Hash]*types.Transaction),
+	}
+	srv := newTestServer(t, newSimpleRateLimiter(testRateLimits(5, 5, time.Hour)), client)
+	srv.cfg.ReplaceAfter = 20 * time.Millisecond
+
+	ethAddress := "0x0101010101010101010101010101010101010101"
+	resp, err := srv.RequestFunds(requestContext("192.0.0.1"), captchaFundingRequest(ethAddress))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := client.numSent(); n != 1 {
+		t.Fatalf("Wanted 1 mined transaction, got %d", n)
+	}
+	mined := client.sent[0]
+	if resp.TransactionHash != mined.Hash().Hex() {
+		t.Errorf("Wanted response with mined tx %s, got %s", mined.Hash().Hex(), resp.TransactionHash)
+	}
+	if mined.Nonce() != 0 || mined.GasFeeCap().Cmp(client.minFeeCap) < 0 {
+		t.Errorf("Wanted replacement at nonce 0 paying at least %v, got %v at nonce %d", client.minFeeCap, mined.GasFeeCap(), mined.Nonce())
+	}
+	st, err := srv.GetFundingStatus(context.Background(), &faucetpb.FundingStatusRequest{RequestId: resp.RequestId})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.State != faucetpb.FundingState_CONFIRMED || st.TransactionHash != mined.Hash().Hex() {
+		t.Errorf("Wanted confirmed status with mined tx %s, got %v", mined.Hash().Hex(), st)
+	}
+}
+
+func TestServer_RequestFunds_maxFundingWait(t *testing.T) {
+	client := &congestedClient{
+		fakeClient: &fakeClient{},
+		minFeeCap:  big.NewInt(1000 * params.GWei),
+		pending:    make(map[common.Hash]*types.Transaction),
+	}
+	srv := newTestServer(t, newSimpleRateLimiter(testRateLimits(5, 5, time.Hour)), client)
+	srv.cfg.MaxFundingWait = 100 * time.Millisecond
+
+	ethAddress := "0x0101010101010101010101010101010101010101"
+	_, err := srv.RequestFunds(requestContext("192.0.0.1"), captchaFundingRequest(ethAddress))
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("Wanted code %v, got %v", codes.DeadlineExceeded, err)
+	}
+	requireDenied(t, err, fundingTimeout)
+	var txHash string
+	for _, detail := range status.Convert(err).Details() {
+		if info, ok := detail.(*errdetails.ErrorInfo); ok {
+			txHash = info.Metadata["txHash"]
+		}
+	}
+	for hash := range client.pending {
+		if txHash != hash.Hex() || !strings.Contains(status.Convert(err).Message(), hash.Hex()) {
+			t.Errorf("Wanted status with pending tx %s, got %v", hash.Hex(), err)
+		}
+	}
+
+	// The pending transaction may still mine, so the request keeps its limits.
+	_, err = srv.RequestFunds(requestContext("192.0.0.1"), captchaFundingRequest(ethAddress))
+	requireDenied(t, err, addressCooldown)
+}
+
+func TestServer_RequestFunds_clientGoesAway(t *testing.T) {
+	client := &fakeClient{}
+	srv := newTestServer(t, newSimpleRateLimiter(testRateLimits(5, 5, time.Hour)), client)
+	srv.cfg.Confirmations = 2
+
+	ctx, cancel := context.WithCancel(requestContext("192.0.0.1"))
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	ethAddress := "0x0101010101010101010101010101010101010101"
+	_, err := srv.RequestFunds(ctx, captchaFundingRequest(ethAddress))
+	if status.Code(err) != codes.Canceled {
+		t.Fatalf("Wanted code %v, got %v", codes.Canceled, err)
+	}
+
+	// Funding carries on in the background after the client went away.
+	client.mineBlocks(1)
+	var id string
+	srv.fundingRequests.mutex.Lock()
+	for requestID := range srv.fundingRequests.requests {
+		id = requestID
+	}
+	srv.fundingRequests.mutex.Unlock()
+	var st *faucetpb.FundingStatusResponse
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if st = srv.fundingRequests.status(id); st.State == faucetpb.FundingState_CONFIRMED {
+			return
+		}
+	}
+	t.Errorf("Wanted request to be confirmed in the background, got %v", st)
+}
@@ -0,0 +1,39 @@
+package internal
+
+import (
+	"context"
+	"time"
+
+	faucetpb "github.com/rauljordan/eth-faucet/proto/faucet"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// RequestChallenge issues a proof-of-work challenge for a wallet address, which
+// can be solved and sent to RequestFunds in place of a captcha response.
+func (s *Server) RequestChallenge(
+	ctx context.Context, req *faucetpb.ChallengeRequest,
+) (*faucetpb.ChallengeResponse, error) {
+	if s.pow == nil {
+		return nil, status.Error(codes.FailedPrecondition, "Proof-of-work challenges are disabled")
+	}
+	walletAddress, err := parseWalletAddress(req.WalletAddress)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Request needs a valid ETH wallet address: %v", err)
+	}
+	challenge, difficulty, expiresAt, err := s.pow.issue(walletAddress, time.Now())
+	if err != nil {
+		log.WithError(err).Error("Could not issue proof-of-work challenge")
+		return nil, status.Errorf(codes.Internal, "Could not issue proof-of-work challenge: %v", err)
+	}
+	log.WithFields(logrus.Fields{
+		"address":    walletAddress.Hex(),
+		"difficulty": difficulty,
+	}).Debug("Issued proof-of-work challenge")
+	return &faucetpb.ChallengeResponse{
+		Challenge:  challenge,
+		Difficulty: uint32(difficulty),
+		ExpiresAt:  expiresAt.Unix(),
+	}, nil
+}
@@ -9,7 +9,6 @@ import (
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
-	"github.com/ethereum/go-ethereum/params"
 	faucetpb "github.com/rauljordan/eth-faucet/proto/faucet"
 	"github.com/sirupsen/logrus"
 	"google.golang.org/grpc/codes"
@@ -17,14 +16,18 @@ import (
 	"google.golang.org/grpc/status"
 )
 
-const weiPerETH = 1e18
-
-// RequestFunds from an Ethereum faucet. Requires a valid captcha response.
+// RequestFunds from an Ethereum faucet, in ETH or one of the configured tokens.
+// Requires a valid captcha response.
 func (s *Server) RequestFunds(
 	ctx context.Context, req *faucetpb.FundingRequest,
 ) (*faucetpb.FundingResponse, error) {
-	if req.WalletAddress == "" {
-		return nil, status.Errorf(codes.InvalidArgument, "Request needs a valid ETH wallet address")
+	walletAddress, err := parseWalletAddress(req.WalletAddress)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Request needs a valid ETH wallet address: %v", err)
+	}
+	token, err := s.lookupToken(req.Asset)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Request needs a valid asset: %v", err)
 	}
 	ipAddress, err := s.getIPAddress(ctx)
 	if err != nil {
@@ -32,89 +35,392 @@ func (s *Server) RequestFunds(
 		return nil, status.Errorf(codes.FailedPrecondition, "Could not get IP address from request: %v", err)
 	}
 
-	// Verify the provided captcha in the request.
-	log.WithField("ipAddress", ipAddress).Info("Verifying captcha...")
-	if err := s.verifyRecaptcha(ipAddress, req); err != nil {
-		log.WithError(err).Error("Failed captcha verification")
-		return nil, status.Errorf(codes.PermissionDenied, "Failed captcha verification: %v", err)
+	// Deny listed ip addresses and ETH addresses before doing any other work.
+	if s.accessLists.denied(ipAddress, walletAddress) {
+		log.WithFields(logrus.Fields{
+			"ipAddress": ipAddress,
+			"address":   walletAddress.Hex(),
+		}).Warn("Denied funding request")
+		return nil, denylistedStatus(ipAddress, walletAddress).Err()
 	}
 
-	// Check if ip should be rate limited.
-	if !s.rateLimiter.shouldAllowRequest(ipAddress, req.WalletAddress) {
-		return nil, status.Error(codes.PermissionDenied, "Funded too recently")
+	// Read the symbol and decimals of a requested token from its contract.
+	asset := fundedAsset{name: ethAsset, symbol: "ETH", decimals: 18, amount: s.fundingAmount, rateLimiter: s.rateLimiter}
+	if token != nil {
+		symbol, decimals, err := token.metadata(ctx, s.client)
+		if err != nil {
+			log.WithError(err).WithField("token", token.name).Error("Could not read token contract")
+			return nil, status.Errorf(codes.Unavailable, "Could not read token contract: %v", err)
+		}
+		asset = fundedAsset{name: token.name, symbol: symbol, decimals: decimals, amount: token.amount, rateLimiter: token.rateLimiter}
 	}
 
-	log.WithFields(logrus.Fields{
+	// Clients authenticated with an api key skip the captcha.
+	key, err := s.apiKeys.authenticate(ctx)
+	if err != nil {
+		log.WithError(err).WithField("ipAddress", ipAddress).Warn("Rejected invalid api key")
+		return nil, status.Error(codes.Unauthenticated, "Invalid API key")
+	}
+	if key == nil {
+		if err := s.verifyCaptcha(ctx, ipAddress, walletAddress, req); err != nil {
+			return nil, err
+		}
+	}
+
+	// Check if ip should be rate limited, and hold its slot while funding.
+	// Allowlisted requests skip the rate limits, and requests with an api key
+	// count against its quota instead.
+	hold, err := s.reserveLimits(asset.rateLimiter, ipAddress, walletAddress, key)
+	if err != nil {
+		var limitErr *rateLimitError
+		if !errors.As(err, &limitErr) {
+			log.WithError(err).Error("Could not check rate limits")
+			return nil, status.Errorf(codes.Internal, "Could not check rate limits: %v", err)
+		}
+		log.WithError(err).Warn("Rate limited funding request")
+		return nil, limitErr.grpcStatus().Err()
+	}
+
+	// Check the faucet-wide spending budget, and hold the funding amount while funding.
+	// Token transfers only count towards the transaction rate.
+	budgetAmount := new(big.Int)
+	if token == nil {
+		budgetAmount = s.fundingAmount
+	}
+	spend, err := s.budget.reserve(budgetAmount)
+	if err != nil {
+		s.releaseLimits(hold)
+		var exhaustedErr *budgetExhaustedError
+		if !errors.As(err, &exhaustedErr) {
+			log.WithError(err).Error("Could not check spending budget")
+			return nil, status.Errorf(codes.Internal, "Could not check spending budget: %v", err)
+		}
+		return nil, exhaustedErr.grpcStatus().Err()
+	}
+
+	fields := logrus.Fields{
 		"ipAddress": ipAddress,
-		"address":   req.WalletAddress,
-	}).Info("Attempting to fund address")
-	txHash, err := s.fundAndWait(common.HexToAddress(req.WalletAddress))
+		"address":   walletAddress.Hex(),
+		"asset":     asset.name,
+	}
+	if key != nil {
+		fields["apiKey"] = key.name
+	}
+
+	// Funding is bounded by the max wait. Broadcasting is tied to the request,
+	// while waiting for the transaction is detached from it, so the request is
+	// settled even if the client goes away after its transaction was broadcast.
+	start := time.Now()
+	sendCtx, cancelSend := s.withFundingDeadline(ctx, start)
+	defer cancelSend()
+
+	// Pick the funder account paying for the request.
+	funder, err := s.funders.acquire(sendCtx, token)
+	if err != nil {
+		s.releaseLimits(hold)
+		s.budget.release(spend)
+		if errors.Is(err, errNoFunder) {
+			log.WithError(err).Error("Faucet is out of funds")
+			return nil, status.Error(codes.Unavailable, "Faucet is out of funds")
+		}
+		log.WithError(err).Error("Could not pick funder")
+		return nil, status.Errorf(codes.Internal, "Could not pick funder: %v", err)
+	}
+	fields["funder"] = funder.address.Hex()
+
+	log.WithFields(fields).Info("Attempting to fund address")
+	requestID, err := s.fundingRequests.add(funder.address)
 	if err != nil {
-		log.WithError(err).Error("Could not send goerli transaction")
+		s.releaseLimits(hold)
+		s.budget.release(spend)
+		s.funders.release(funder)
+		log.WithError(err).Error("Could not queue funding request")
+		return nil, status.Errorf(codes.Internal, "Could not queue funding request: %v", err)
+	}
+	p, err := s.newPayment(sendCtx, funder, walletAddress, token)
+	if err != nil {
+		s.releaseLimits(hold)
+		s.budget.release(spend)
+		s.funders.release(funder)
+		s.fundingRequests.failed(requestID, err)
+		log.WithError(err).WithField("token", token.name).Error("Could not build token transfer")
+		return nil, status.Errorf(codes.Internal, "Could not build token transfer: %v", err)
+	}
+	tx, err := s.broadcastFunding(sendCtx, funder, p)
+	if err != nil {
+		s.releaseLimits(hold)
+		s.budget.release(spend)
+		s.funders.release(funder)
+		s.fundingRequests.failed(requestID, err)
+		log.WithError(err).WithField("funder", funder.address.Hex()).Error("Could not send goerli transaction")
 		return nil, status.Errorf(codes.Internal, "Could not send goerli transaction: %v", err)
 	}
+	s.fundingRequests.broadcast(requestID, tx.Hash())
 
-	// Mark the ip and Ethereum address pair as funded for the rate limiter.
-	s.rateLimiter.markAsFunded(ipAddress, req.WalletAddress)
+	type fundingResult struct {
+		receipt *types.Receipt
+		err     error
+	}
+	waitCtx, cancelWait := s.withFundingDeadline(s.shutdownCtx, start)
+	done := make(chan fundingResult, 1)
+	go func() {
+		defer cancelWait()
+		defer s.funders.release(funder)
+		receipt, err := s.awaitFunding(waitCtx, requestID, funder, walletAddress, tx, hold, spend)
+		done <- fundingResult{receipt: receipt, err: err}
+	}()
 
-	log.WithFields(logrus.Fields{
-		"txHash":           txHash,
-		"requesterAddress": req.WalletAddress,
-	}).Info("Funded successfully")
+	// Asynchronous requests answer as soon as the transaction is broadcast, and
+	// clients poll GetFundingStatus while it mines in the background.
+	txHash := tx.Hash()
+	if !s.cfg.AsyncFunding {
+		select {
+		case res := <-done:
+			if res.err != nil {
+				return nil, fundingFailedStatus(res.err).Err()
+			}
+			// The transaction which mined may be a replacement of the one broadcast.
+			txHash = res.receipt.TxHash
+		case <-ctx.Done():
+			return nil, fundingFailedStatus(&waitAbortedError{txHash: txHash, err: ctx.Err()}).Err()
+		}
+	}
 
-	fundingAmountWei := new(big.Float).SetInt(s.fundingAmount)
-	fundedETH := new(big.Float).Quo(fundingAmountWei, big.NewFloat(weiPerETH))
 	return &faucetpb.FundingResponse{
-		Amount:          fundedETH.String(),
-		TransactionHash: txHash,
+		Amount:          formatAmount(asset.amount, asset.decimals),
+		TransactionHash: txHash.Hex(),
+		RequestId:       requestID,
+		FunderAddress:   funder.address.Hex(),
+		Asset:           asset.name,
+		Symbol:          asset.symbol,
+		Decimals:        uint32(asset.decimals),
 	}, nil
 }
 
-func (s *Server) fundAndWait(to common.Address) (string, error) {
-	nonce := uint64(0)
-	nonce, err := s.client.PendingNonceAt(context.Background(), s.funder)
-	if err != nil {
-		return "", fmt.Errorf("could not get nonce: %w", err)
-	}
-
-	tx := types.NewTransaction(
-		nonce,
-		to,
-		s.fundingAmount,
-		s.cfg.GasLimit,
-		big.NewInt(1*params.GWei), /* testnet gas price */
-		nil,                       /* data */
-	)
-	tx, err = types.SignTx(tx, types.NewEIP155Signer(big.NewInt(s.cfg.ChainId)), s.pk)
+// Asset funded by a request, along with the rate limiter counting its requests.
+type fundedAsset struct {
+	name        string
+	symbol      string
+	decimals    uint8
+	amount      *big.Int
+	rateLimiter rateLimiter
+}
+
+// Waits for a broadcast funding transaction to be confirmed, committing the rate limits
+// held by the request once it did and releasing them and its spend if it failed.
+// If the wait is given up while the transaction may still mine, the request keeps
+// holding its rate limits and spend until they expire.
+func (s *Server) awaitFunding(
+	ctx context.Context,
+	requestID string,
+	funder *funder,
+	to common.Address,
+	tx *types.Transaction,
+	hold *limitHold,
+	spend *spend,
+) (*types.Receipt, error) {
+	receipt, err := s.waitConfirmed(ctx, requestID, funder, tx)
 	if err != nil {
-		return "", fmt.Errorf("could not sign tx: %w", err)
+		s.fundingRequests.failed(requestID, err)
+		var abortedErr *waitAbortedError
+		if errors.As(err, &abortedErr) {
+			log.WithError(err).WithField("txHash", abortedErr.txHash.Hex()).Warn("Gave up waiting for funding transaction")
+			return nil, err
+		}
+		s.releaseLimits(hold)
+		s.budget.release(spend)
+		if errors.Is(err, errTxDropped) {
+			// The dropped nonce leaves a gap every later transaction of the
+			// funder would wait behind, so resync with the node to reuse it.
+			funder.nonces.invalidate()
+		}
+		log.WithError(err).WithField("txHash", tx.Hash().Hex()).Error("Could not fund address")
+		return nil, err
 	}
+	// Mark the ip and Ethereum address pair as funded for the rate limiter,
+	// only once the transaction is confirmed.
+	s.commitLimits(hold)
+	s.fundingRequests.confirmed(requestID)
+
+	log.WithFields(logrus.Fields{
+		"txHash":           receipt.TxHash.Hex(),
+		"requesterAddress": to.Hex(),
+		"funder":           funder.address.Hex(),
+		"blockNumber":      receipt.BlockNumber,
+	}).Info("Funded successfully")
+	return receipt, nil
+}
 
-	if err := s.client.SendTransaction(context.Background(), tx); err != nil {
-		return "", fmt.Errorf("could not send tx: %w", err)
+// Verifies the captcha or proof of work of a request, rejecting clients
+// banned after repeated captcha failures before verifying.
+func (s *Server) verifyCaptcha(
+	ctx context.Context, ipAddress string, walletAddress common.Address, req *faucetpb.FundingRequest,
+) error {
+	if banErr := s.penalties.check(ipAddress, walletAddress, time.Now()); banErr != nil {
+		captchaBannedRequestsTotal.Inc()
+		log.WithError(banErr).Warn("Rejected banned funding request")
+		return banErr.grpcStatus().Err()
 	}
 
-	// Wait for transaction to mine.
-	log.WithField("txHash", fmt.Sprintf("%#x", tx.Hash())).Info("Awaiting for tx to mine...")
-	start := time.Now()
-	for pending := true; pending; _, pending, err = s.client.TransactionByHash(context.Background(), tx.Hash()) {
+	// Verify the provided captcha or proof of work in the request.
+	log.WithField("ipAddress", ipAddress).Info("Verifying captcha...")
+	if err := s.verifyChallenge(ctx, ipAddress, walletAddress, req); err != nil {
+		if errors.Is(err, errCaptchaUnavailable) {
+			log.WithError(err).Error("Could not verify captcha")
+			return status.Errorf(codes.Unavailable, "Could not verify captcha: %v", err)
+		}
+		if errors.Is(err, errNoCaptchaSite) {
+			log.WithError(err).Error("Could not verify captcha")
+			return status.Errorf(codes.FailedPrecondition, "Could not verify captcha: %v", err)
+		}
+		captchaFailuresTotal.Inc()
+		s.penalties.recordFailure(ipAddress, walletAddress, time.Now())
+		log.WithError(err).Error("Failed captcha verification")
+		return status.Errorf(codes.PermissionDenied, "Failed captcha verification: %v", err)
+	}
+	s.penalties.recordSuccess(ipAddress, walletAddress)
+	return nil
+}
+
+// Rate limits held by a funding request until it succeeded or failed.
+type limitHold struct {
+	// Nil for allowlisted requests.
+	reservation *reservation
+	// Rate limiter of the funded asset, or of the api key, holding the reservation.
+	rateLimiter rateLimiter
+}
+
+// Reserves the rate limits of the funded asset for the request, unless the ip
+// address or ETH address is allowlisted, or a use of the api key quota if the
+// request was made with an api key. The rate limits are keyed on the checksummed address,
+// so differently cased spellings of an address share its limits.
+func (s *Server) reserveLimits(
+	limiter rateLimiter, ipAddress string, walletAddress common.Address, key *apiKey,
+) (*limitHold, error) {
+	if key != nil {
+		r, err := s.apiKeys.reserve(key, ipAddress)
 		if err != nil {
-			return "", fmt.Errorf("could not wait for tx to mine: %w", err)
+			return nil, err
 		}
-		time.Sleep(1 * time.Second)
+		return &limitHold{reservation: r, rateLimiter: key.rateLimiter}, nil
 	}
-	log.WithFields(logrus.Fields{
-		"timeElapsed": fmt.Sprintf("%v", time.Since(start)),
-		"txHash":      fmt.Sprintf("%#x", tx.Hash()),
-	}).Info("Transaction mined")
-	return tx.Hash().Hex(), nil
+	if s.accessLists.allowed(ipAddress, walletAddress) {
+		log.WithFields(logrus.Fields{
+			"ipAddress": ipAddress,
+			"address":   walletAddress.Hex(),
+		}).Info("Skipping rate limits for allowlisted request")
+		return &limitHold{}, nil
+	}
+	r, err := limiter.reserve(ipAddress, walletAddress.Hex())
+	if err != nil {
+		return nil, err
+	}
+	return &limitHold{reservation: r, rateLimiter: limiter}, nil
+}
+
+func (s *Server) releaseLimits(h *limitHold) {
+	if h.reservation != nil {
+		h.rateLimiter.release(h.reservation)
+	}
+}
+
+func (s *Server) commitLimits(h *limitHold) {
+	if h.reservation != nil {
+		h.rateLimiter.commit(h.reservation)
+	}
+}
+
+// Transfer made by a funding transaction, either a plain transfer of ETH or
+// a call to a token contract.
+type payment struct {
+	to    common.Address
+	value *big.Int
+	data  []byte
+	gas   uint64
 }
 
+// Payment of the ETH funding amount to the address.
+func (s *Server) ethPayment(to common.Address) payment {
+	return payment{to: to, value: s.fundingAmount, gas: s.cfg.GasLimit}
+}
+
+// Payment of the funding amount of ETH or of the token to the address. Token
+// transfers are paid by the funder, so their gas is estimated from its account.
+func (s *Server) newPayment(ctx context.Context, funder *funder, to common.Address, token *erc20Token) (payment, error) {
+	if token == nil {
+		return s.ethPayment(to), nil
+	}
+	return token.payment(ctx, s.client, funder.address, to)
+}
+
+// Broadcasts a funding transaction making the payment, paid by the funder.
+func (s *Server) broadcastFunding(ctx context.Context, funder *funder, p payment) (*types.Transaction, error) {
+	tx, err := s.sendFundingTx(ctx, funder, p)
+	if isNonceError(err) {
+		// Another sender used the funder's account, so resync and retry once.
+		log.WithError(err).WithField("funder", funder.address.Hex()).Warn("Funder nonce out of sync, resyncing with node")
+		funder.nonces.invalidate()
+		tx, err = s.sendFundingTx(ctx, funder, p)
+	}
+	return tx, err
+}
+
+// Signs and broadcasts a funding transaction with the next nonce of the funder,
+// handing the nonce back if the transaction never made it to the node.
+func (s *Server) sendFundingTx(ctx context.Context, funder *funder, p payment) (*types.Transaction, error) {
+	nonce, err := funder.nonces.acquire(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not get nonce: %w", err)
+	}
+	tx, err := s.newFundingTx(ctx, nonce, p)
+	if err != nil {
+		funder.nonces.release(nonce)
+		return nil, fmt.Errorf("could not build tx: %w", err)
+	}
+	tx, err = funder.signer.signTx(ctx, tx, big.NewInt(s.cfg.ChainId))
+	if err != nil {
+		funder.nonces.release(nonce)
+		return nil, fmt.Errorf("could not sign tx: %w", err)
+	}
+	if err := s.client.SendTransaction(ctx, tx); err != nil {
+		if !isNonceError(err) {
+			funder.nonces.release(nonce)
+		}
+		return nil, fmt.Errorf("could not send tx: %w", err)
+	}
+	return tx, nil
+}
+
+// Derives a context from the parent which expires the max funding wait after
+// the funding started, if the wait is bounded.
+func (s *Server) withFundingDeadline(parent context.Context, start time.Time) (context.Context, context.CancelFunc) {
+	if s.cfg.MaxFundingWait <= 0 {
+		return context.WithCancel(parent)
+	}
+	return context.WithDeadline(parent, start.Add(s.cfg.MaxFundingWait))
+}
+
+// Client ip address of the request, as forwarded by the http gateway and the
+// trusted proxies in front of it.
 func (s *Server) getIPAddress(ctx context.Context) (string, error) {
 	md, ok := metadata.FromIncomingContext(ctx)
 	if !ok || len(md.Get("x-forwarded-for")) < 1 {
 		return "", errors.New("metadata not ok")
 	}
-	address := md.Get("x-forwarded-for")[0]
-	return address, nil
+	return clientIP(md.Get("x-forwarded-for"), s.cfg.TrustedProxies), nil
+}
+
+// Origin of the frontend the request was made from, as forwarded by the http
+// gateway or set by gRPC clients, falling back to the referer.
+func getOrigin(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	for _, key := range []string{"origin", "grpcgateway-origin", "referer", "grpcgateway-referer"} {
+		if values := md.Get(key); len(values) > 0 && values[0] != "" {
+			return values[0]
+		}
+	}
+	return ""
 }
@@ -0,0 +1,737 @@
+package internal
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/params"
+	faucetpb "github.com/rauljordan/eth-faucet/proto/faucet"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Ethereum client which mines every sent transaction immediately, in its own
+// block on top of which further blocks can be mined. Chains without a base fee
+// have not activated London yet.
+type fakeClient struct {
+	mutex    sync.Mutex
+	sent     []*types.Transaction
+	blocks   uint64
+	reverted bool
+	baseFee  *big.Int
+	gasTip   *big.Int
+	gasPrice *big.Int
+	sendErr  error
+	balances map[common.Address]*big.Int
+	// Token balances of accounts, which hold plenty unless listed.
+	tokenBalances map[common.Address]*big.Int
+	refusesTokens bool
+}
+
+func (c *fakeClient) PendingNonceAt(_ context.Context, _ common.Address) (uint64, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return uint64(len(c.sent)), nil
+}
+
+func (c *fakeClient) SendTransaction(_ context.Context, tx *types.Transaction) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.sendErr != nil {
+		return c.sendErr
+	}
+	for _, sent := range c.sent {
+		if sent.Nonce() == tx.Nonce() {
+			return core.ErrNonceTooLow
+		}
+	}
+	c.sent = append(c.sent, tx)
+	return nil
+}
+
+func (c *fakeClient) TransactionByHash(_ context.Context, hash common.Hash) (*types.Transaction, bool, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, tx := range c.sent {
+		if tx.Hash() == hash {
+			return tx, false, nil
+		}
+	}
+	return nil, false, ethereum.NotFound
+}
+
+func (c *fakeClient) TransactionReceipt(_ context.Context, hash common.Hash) (*types.Receipt, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for i, tx := range c.sent {
+		if tx.Hash() == hash {
+			receipt := &types.Receipt{
+				Status:      types.ReceiptStatusSuccessful,
+				TxHash:      hash,
+				BlockHash:   common.BigToHash(big.NewInt(int64(i + 1))),
+				BlockNumber: big.NewInt(int64(i + 1)),
+			}
+			if c.reverted {
+				receipt.Status = types.ReceiptStatusFailed
+			}
+			return receipt, nil
+		}
+	}
+	return nil, ethereum.NotFound
+}
+
+func (c *fakeClient) BlockNumber(_ context.Context) (uint64, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return uint64(len(c.sent)) + c.blocks, nil
+}
+
+func (c *fakeClient) mineBlocks(n uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.blocks += n
+}
+
+func (c *fakeClient) BalanceAt(_ context.Context, account common.Address, _ *big.Int) (*big.Int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if bal, ok := c.balances[account]; ok {
+		return bal, nil
+	}
+	return new(big.Int).Mul(big.NewInt(1000), big.NewInt(params.Ether)), nil
+}
+
+func (c *fakeClient) HeaderByNumber(_ context.Context, _ *big.Int) (*types.Header, error) {
+	return &types.Header{Number: big.NewInt(1), BaseFee: c.baseFee}, nil
+}
+
+func (c *fakeClient) SuggestGasTipCap(_ context.Context) (*big.Int, error) {
+	if c.gasTip == nil {
+		return big.NewInt(params.GWei), nil
+	}
+	return c.gasTip, nil
+}
+
+func (c *fakeClient) SuggestGasPrice(_ context.Context) (*big.Int, error) {
+	if c.gasPrice == nil {
+		return big.NewInt(params.GWei), nil
+	}
+	return c.gasPrice, nil
+}
+
+// Answers calls to every contract as a token with 6 decimals, whose transfers
+// return whether the token accepts them.
+func (c *fakeClient) CallContract(_ context.Context, call ethereum.CallMsg, _ *big.Int) ([]byte, error) {
+	method, err := erc20ABI.MethodById(call.Data)
+	if err != nil {
+		return nil, err
+	}
+	switch method.Name {
+	case "decimals":
+		return method.Outputs.Pack(uint8(6))
+	case "symbol":
+		return method.Outputs.Pack("TST")
+	case "balanceOf":
+		args, err := method.Inputs.Unpack(call.Data[4:])
+		if err != nil {
+			return nil, err
+		}
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		if bal, ok := c.tokenBalances[args[0].(common.Address)]; ok {
+			return method.Outputs.Pack(bal)
+		}
+		return method.Outputs.Pack(big.NewInt(params.Ether))
+	case "transfer":
+		return method.Outputs.Pack(!c.refusesTokens)
+	}
+	return nil, fmt.Errorf("unexpected call of %s", method.Name)
+}
+
+func (c *fakeClient) EstimateGas(_ context.Context, _ ethereum.CallMsg) (uint64, error) {
+	return 51000, nil
+}
+
+func (c *fakeClient) numSent() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.sent)
+}
+
+// Captcha verifier which accepts every response naming the wallet address,
+// optionally followed by a colon and a suffix making the token unique.
+type fakeCaptcha struct{}
+
+func (fakeCaptcha) verify(_ context.Context, _, _, response string, walletAddress common.Address) error {
+	named := strings.SplitN(response, ":", 2)[0]
+	if !common.IsHexAddress(named) || common.HexToAddress(named) != walletAddress {
+		return fmt.Errorf("response %s does not name %s", response, walletAddress.Hex())
+	}
+	return nil
+}
+
+func (fakeCaptcha) maxChallengeAge() time.Duration {
+	return maxCaptchaChallengeAge
+}
+
+// Unique captcha response accepted by the fake captcha for the wallet address.
+func captchaToken(ethAddress string) string {
+	return fmt.Sprintf("%s:%d", ethAddress, atomic.AddUint64(&captchaTokens, 1))
+}
+
+var captchaTokens uint64
+
+func newTestServer(t *testing.T, rl rateLimiter, client ethClient) *Server {
+	pk, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lists, err := newAccessLists("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Server{
+		cfg: &Config{
+			GasLimit:      21000,
+			ChainId:       5,
+			Confirmations: 1,
+		},
+		captcha:                 fakeCaptcha{},
+		client:                  client,
+		funders:                 newFunderPool(client, []txSigner{&keySigner{pk: pk}}, mostBalanceStrategy, new(big.Int), big.NewInt(params.Ether)),
+		fundingAmount:           big.NewInt(params.Ether),
+		maxFeePerGas:            big.NewInt(100 * params.GWei),
+		maxPriorityFeePerGas:    big.NewInt(2 * params.GWei),
+		maxReplacementFeePerGas: big.NewInt(500 * params.GWei),
+		rateLimiter:             rl,
+		budget:                  newSpendingBudget(nil, 0, 0),
+		accessLists:             lists,
+		usedTokens:              newUsedTokenCache(100),
+		penalties:               newCaptchaPenalties(&Config{}),
+		apiKeys:                 &apiKeys{keys: make(map[[sha256.Size]byte]*apiKey)},
+		fundingRequests:         newFundingRequests(time.Hour),
+		pollInterval:            10 * time.Millisecond,
+		shutdownCtx:             context.Background(),
+	}
+}
+
+func requestContext(ipAddress string) context.Context {
+	return metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-forwarded-for", ipAddress))
+}
+
+// Requires the error to be a gRPC status denying the request for the reason.
+func requireDenied(t *testing.T, err error, reason string) {
+	t.Helper()
+	if err == nil {
+		t.Fatalf("Wanted request to be denied with reason %s", reason)
+	}
+	for _, detail := range status.Convert(err).Details() {
+		if info, ok := detail.(*errdetails.ErrorInfo); ok {
+			if info.Reason != reason {
+				t.Errorf("Wanted reason %s, got %s", reason, info.Reason)
+			}
+			return
+		}
+	}
+	t.Errorf("Wanted error info with reason %s, got %v", reason, err)
+}
+
+func TestServer_RequestFunds_concurrentRequestsFundOnce(t *testing.T) {
+	for _, backend := range rateLimiterBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			client := &fakeClient{}
+			srv := newTestServer(t, backend.new(t, testRateLimits(5, 5, time.Hour)), client)
+			ethAddress := "0x0101010101010101010101010101010101010101"
+			numRequests := 10
+
+			var wg sync.WaitGroup
+			var mutex sync.Mutex
+			funded := 0
+			for i := 0; i < numRequests; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					_, err := srv.RequestFunds(requestContext(fmt.Sprintf("192.0.0.%d", i)), &faucetpb.FundingRequest{
+						WalletAddress:   ethAddress,
+						CaptchaResponse: captchaToken(ethAddress),
+					})
+					if err == nil {
+						mutex.Lock()
+						funded++
+						mutex.Unlock()
+					}
+				}(i)
+			}
+			wg.Wait()
+
+			if funded != 1 {
+				t.Errorf("Wanted exactly 1 funded request, got %d", funded)
+			}
+			if sent := client.numSent(); sent != 1 {
+				t.Errorf("Wanted exactly 1 transaction, got %d", sent)
+			}
+		})
+	}
+}
+
+func TestServer_RequestFunds_concurrentRequestsUseSequentialNonces(t *testing.T) {
+	client := &fakeClient{}
+	srv := newTestServer(t, newSimpleRateLimiter(testRateLimits(5, 5, time.Hour)), client)
+	numRequests := 10
+
+	var wg sync.WaitGroup
+	for i := 0; i < numRequests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ethAddress := common.BigToAddress(big.NewInt(int64(0x1000 + i))).Hex()
+			_, err := srv.RequestFunds(requestContext(fmt.Sprintf("192.0.0.%d", i)), &faucetpb.FundingRequest{
+				WalletAddress:   ethAddress,
+				CaptchaResponse: captchaToken(ethAddress),
+			})
+			if err != nil {
+				t.Errorf("Request %d failed: %v", i, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	seen := make(map[uint64]bool)
+	for _, tx := range client.sent {
+		if seen[tx.Nonce()] {
+			t.Errorf("Nonce %d used twice", tx.Nonce())
+		}
+		seen[tx.Nonce()] = true
+	}
+	for nonce := uint64(0); nonce < uint64(numRequests); nonce++ {
+		if !seen[nonce] {
+			t.Errorf("Wanted nonce %d to be used", nonce)
+		}
+	}
+}
+
+func TestServer_RequestFunds_resyncsNonceTooLow(t *testing.T) {
+	client := &fakeClient{}
+	srv := newTestServer(t, newSimpleRateLimiter(testRateLimits(5, 5, 0)), client)
+	if err := srv.funders.funders[0].nonces.sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// Another sender uses the funder's account behind the faucet's back.
+	client.sent = append(client.sent, types.NewTx(&types.LegacyTx{Nonce: 0}))
+
+	ethAddress := "0x0101010101010101010101010101010101010101"
+	if _, err := srv.RequestFunds(requestContext("192.0.0.1"), &faucetpb.FundingRequest{
+		WalletAddress:   ethAddress,
+		CaptchaResponse: captchaToken(ethAddress),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if nonce := client.sent[1].Nonce(); nonce != 1 {
+		t.Errorf("Wanted funding tx with nonce 1 after resync, got %d", nonce)
+	}
+}
+
+func TestServer_RequestFunds_reclaimsNonceOfFailedSend(t *testing.T) {
+	client := &fakeClient{sendErr: errors.New("connection refused")}
+	srv := newTestServer(t, newSimpleRateLimiter(testRateLimits(5, 5, 0)), client)
+
+	ethAddress := "0x0101010101010101010101010101010101010101"
+	if _, err := srv.RequestFunds(requestContext("192.0.0.1"), &faucetpb.FundingRequest{
+		WalletAddress:   ethAddress,
+		CaptchaResponse: captchaToken(ethAddress),
+	}); err == nil {
+		t.Fatal("Wanted failed send to fail the request")
+	}
+
+	client.sendErr = nil
+	if _, err := srv.RequestFunds(requestContext("192.0.0.1"), &faucetpb.FundingRequest{
+		WalletAddress:   ethAddress,
+		CaptchaResponse: captchaToken(ethAddress),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if nonce := client.sent[0].Nonce(); nonce != 0 {
+		t.Errorf("Wanted nonce 0 to be reused, got %d", nonce)
+	}
+}
+
+func TestServer_RequestFunds_fundingStatus(t *testing.T) {
+	tests := []struct {
+		name  string
+		async bool
+	}{
+		{name: "sync"},
+		{name: "async", async: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &fakeClient{}
+			srv := newTestServer(t, newSimpleRateLimiter(testRateLimits(5, 5, 0)), client)
+			srv.cfg.AsyncFunding = tt.async
+
+			ethAddress := "0x0101010101010101010101010101010101010101"
+			resp, err := srv.RequestFunds(requestContext("192.0.0.1"), &faucetpb.FundingRequest{
+				WalletAddress:   ethAddress,
+				CaptchaResponse: captchaToken(ethAddress),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.RequestId == "" || resp.TransactionHash == "" {
+				t.Fatalf("Wanted request id and transaction hash, got %v", resp)
+			}
+
+			req := &faucetpb.FundingStatusRequest{RequestId: resp.RequestId}
+			st, err := srv.GetFundingStatus(context.Background(), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.async && st.State != faucetpb.FundingState_BROADCAST {
+				t.Errorf("Wanted async request to answer once broadcast, got %v", st.State)
+			}
+			for deadline := time.Now().Add(5 * time.Second); st.State != faucetpb.FundingState_CONFIRMED && time.Now().Before(deadline); {
+				time.Sleep(100 * time.Millisecond)
+				if st, err = srv.GetFundingStatus(context.Background(), req); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if st.State != faucetpb.FundingState_CONFIRMED {
+				t.Fatalf("Wanted request to be confirmed, got %v", st.State)
+			}
+			if st.TransactionHash != resp.TransactionHash || st.BlockNumber != 1 {
+				t.Errorf("Wanted tx %s in block 1, got tx %s in block %d", resp.TransactionHash, st.TransactionHash, st.BlockNumber)
+			}
+		})
+	}
+}
+
+func TestServer_GetFundingStatus_unknownRequest(t *testing.T) {
+	srv := newTestServer(t, newSimpleRateLimiter(testRateLimits(5, 5, 0)), &fakeClient{})
+	_, err := srv.GetFundingStatus(context.Background(), &faucetpb.FundingStatusRequest{RequestId: "00ff"})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("Wanted code %v, got %v", codes.NotFound, err)
+	}
+	_, err = srv.GetFundingStatus(context.Background(), &faucetpb.FundingStatusRequest{})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Wanted code %v, got %v", codes.InvalidArgument, err)
+	}
+}
+
+func TestServer_RequestFunds_accessLists(t *testing.T) {
+	dir := t.TempDir()
+	allowlist := writeAccessList(t, dir, "allowlist", "0x0202020202020202020202020202020202020202")
+	denylist := writeAccessList(t, dir, "denylist", "0x0303030303030303030303030303030303030303\n10.0.0.0/8")
+	lists, err := newAccessLists(allowlist, denylist)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &fakeClient{}
+	srv := newTestServer(t, newSimpleRateLimiter(testRateLimits(5, 5, time.Hour)), client)
+	srv.accessLists = lists
+
+	request := func(ipAddress, ethAddress string) error {
+		_, err := srv.RequestFunds(requestContext(ipAddress), &faucetpb.FundingRequest{
+			WalletAddress:   ethAddress,
+			CaptchaResponse: captchaToken(ethAddress),
+		})
+		return err
+	}
+
+	// Allowlisted addresses skip the address cooldown.
+	for i := 0; i < 3; i++ {
+		if err := request("192.0.0.1", "0x0202020202020202020202020202020202020202"); err != nil {
+			t.Fatalf("Allowlisted request %d failed: %v", i, err)
+		}
+	}
+	if err := request("192.0.0.1", "0x0101010101010101010101010101010101010101"); err != nil {
+		t.Fatal(err)
+	}
+	requireDenied(t, request("192.0.0.1", "0x0101010101010101010101010101010101010101"), addressCooldown)
+
+	requireDenied(t, request("192.0.0.1", "0x0303030303030303030303030303030303030303"), denylisted)
+	requireDenied(t, request("10.1.2.3", "0x0404040404040404040404040404040404040404"), denylisted)
+	if sent := client.numSent(); sent != 4 {
+		t.Errorf("Wanted 4 transactions, got %d", sent)
+	}
+}
+
+func TestServer_RequestFunds_spoofedAllowlistedIP(t *testing.T) {
+	lists, err := newAccessLists(writeAccessList(t, t.TempDir(), "allowlist", "10.0.0.0/8"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newTestServer(t, newSimpleRateLimiter(testRateLimits(5, 5, time.Hour)), &fakeClient{})
+	srv.accessLists = lists
+	request := func(forwardedFor, ethAddress string) error {
+		_, err := srv.RequestFunds(requestContext(forwardedFor), &faucetpb.FundingRequest{
+			WalletAddress:   ethAddress,
+			CaptchaResponse: captchaToken(ethAddress),
+		})
+		return err
+	}
+
+	ethAddress := "0x0101010101010101010101010101010101010101"
+	if err := request("10.0.0.1, 203.0.113.7", ethAddress); err != nil {
+		t.Fatal(err)
+	}
+	requireDenied(t, request("10.0.0.1, 203.0.113.7", ethAddress), addressCooldown)
+
+	// Requests really coming from the allowlisted range still skip the limits.
+	if err := request("10.0.0.1", ethAddress); err != nil {
+		t.Errorf("Wanted allowlisted ip to skip the address cooldown: %v", err)
+	}
+}
+
+func TestServer_RequestFunds_canonicalAddress(t *testing.T) {
+	client := &fakeClient{}
+	srv := newTestServer(t, newSimpleRateLimiter(testRateLimits(5, 5, time.Hour)), client)
+	request := func(ethAddress string) error {
+		_, err := srv.RequestFunds(requestContext("192.0.0.1"), &faucetpb.FundingRequest{
+			WalletAddress:   ethAddress,
+			CaptchaResponse: captchaToken(ethAddress),
+		})
+		return err
+	}
+
+	for _, invalid := range []string{"", "0xabc", "0x8Ba1f109551bD432803012645Ac136ddd64DBA72"} {
+		if code := status.Code(request(invalid)); code != codes.InvalidArgument {
+			t.Errorf("Wanted %v for address %q, got %v", codes.InvalidArgument, invalid, code)
+		}
+	}
+
+	if err := request("0x8ba1f109551bD432803012645Ac136ddd64DBA72"); err != nil {
+		t.Fatal(err)
+	}
+	// Differently cased spellings of the address share its cooldown.
+	requireDenied(t, request("0x8ba1f109551bd432803012645ac136ddd64dba72"), addressCooldown)
+	if sent := client.numSent(); sent != 1 {
+		t.Errorf("Wanted exactly 1 transaction, got %d", sent)
+	}
+}
+
+func TestServer_RequestFunds_spoofedForwardedFor(t *testing.T) {
+	srv := newTestServer(t, newSimpleRateLimiter(testRateLimits(5, 1, time.Hour)), &fakeClient{})
+	request := func(forwardedFor, ethAddress string) error {
+		_, err := srv.RequestFunds(requestContext(forwardedFor), &faucetpb.FundingRequest{
+			WalletAddress:   ethAddress,
+			CaptchaResponse: captchaToken(ethAddress),
+		})
+		return err
+	}
+
+	// Hops sent by the client ahead of the one appended by the gateway don't
+	// change the ip the request is limited under.
+	if err := request("10.0.0.1, 203.0.113.7", "0x0101010101010101010101010101010101010101"); err != nil {
+		t.Fatal(err)
+	}
+	requireDenied(t, request("10.0.0.2, 203.0.113.7", "0x0202020202020202020202020202020202020202"), addressLimitPerIP)
+}
+
+func TestServer_RequestFunds_proofOfWork(t *testing.T) {
+	client := &fakeClient{}
+	srv := newTestServer(t, newSimpleRateLimiter(testRateLimits(5, 5, time.Hour)), client)
+	srv.captcha = nil
+	srv.pow = newTestPowChallenger(t, 8, 8, 0)
+	ethAddress := "0x0101010101010101010101010101010101010101"
+
+	if _, err := srv.RequestFunds(requestContext("192.0.0.1"), &faucetpb.FundingRequest{
+		WalletAddress:   ethAddress,
+		CaptchaResponse: ethAddress,
+	}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Wanted request without proof of work to be denied, got %v", err)
+	}
+
+	challenge, err := srv.RequestChallenge(context.Background(), &faucetpb.ChallengeRequest{WalletAddress: ethAddress})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := srv.RequestFunds(requestContext("192.0.0.1"), &faucetpb.FundingRequest{
+		WalletAddress: ethAddress,
+		PowChallenge:  challenge.Challenge,
+		PowNonce:      solvePow(challenge.Challenge, uint8(challenge.Difficulty)),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if sent := client.numSent(); sent != 1 {
+		t.Errorf("Wanted exactly 1 transaction, got %d", sent)
+	}
+}
+
+func TestServer_RequestFunds_rejectsReusedCaptcha(t *testing.T) {
+	client := &fakeClient{}
+	srv := newTestServer(t, newSimpleRateLimiter(testRateLimits(5, 5, time.Hour)), client)
+	token := captchaToken("0x0101010101010101010101010101010101010101")
+	request := func(ethAddress string) error {
+		_, err := srv.RequestFunds(requestContext("192.0.0.1"), &faucetpb.FundingRequest{
+			WalletAddress:   ethAddress,
+			CaptchaResponse: token,
+		})
+		return err
+	}
+
+	// A token failing verification can be retried.
+	if err := request("0x0202020202020202020202020202020202020202"); err == nil {
+		t.Fatal("Wanted token for another address to fail verification")
+	}
+	if err := request("0x0101010101010101010101010101010101010101"); err != nil {
+		t.Fatal(err)
+	}
+	if err := request("0x0101010101010101010101010101010101010101"); status.Code(err) != codes.PermissionDenied ||
+		!strings.Contains(err.Error(), "already used") {
+		t.Errorf("Wanted reused token to be denied, got %v", err)
+	}
+	if sent := client.numSent(); sent != 1 {
+		t.Errorf("Wanted exactly 1 transaction, got %d", sent)
+	}
+}
+
+// Captcha verifier counting how often the provider would have been called.
+type countingCaptcha struct {
+	fakeCaptcha
+	calls int
+}
+
+func (c *countingCaptcha) verify(ctx context.Context, remoteIP, origin, response string, walletAddress common.Address) error {
+	c.calls++
+	return c.fakeCaptcha.verify(ctx, remoteIP, origin, response, walletAddress)
+}
+
+func TestServer_RequestFunds_bansRepeatedCaptchaFailures(t *testing.T) {
+	ethAddress := "0x0101010101010101010101010101010101010101"
+	tests := []struct {
+		name             string
+		failuresPerAddr  int
+		wantAddressBan   bool
+		wantCaptchaCalls int
+	}{
+		// Address bans are off by default, so the address named by the failed
+		// captchas can still be funded from other ips.
+		{name: "ip_bans", failuresPerAddr: 0, wantAddressBan: false, wantCaptchaCalls: 4},
+		{name: "address_bans", failuresPerAddr: 3, wantAddressBan: true, wantCaptchaCalls: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newTestServer(t, newSimpleRateLimiter(testRateLimits(5, 5, time.Hour)), &fakeClient{})
+			captcha := &countingCaptcha{}
+			srv.captcha = captcha
+			srv.penalties = newCaptchaPenalties(&Config{
+				CaptchaFailuresPerIP:      3,
+				CaptchaFailuresPerAddress: tt.failuresPerAddr,
+				CaptchaFailureWindow:      time.Hour,
+				CaptchaBanDuration:        time.Minute,
+				CaptchaMaxBanDuration:     time.Hour,
+			})
+			request := func(ipAddress, response string) error {
+				_, err := srv.RequestFunds(requestContext(ipAddress), &faucetpb.FundingRequest{
+					WalletAddress:   ethAddress,
+					CaptchaResponse: response,
+				})
+				return err
+			}
+
+			for i := 0; i < 3; i++ {
+				if err := request("192.0.0.1", fmt.Sprintf("bad-token-%d", i)); status.Code(err) != codes.PermissionDenied {
+					t.Fatalf("Wanted failed captcha to be denied, got %v", err)
+				}
+			}
+			// The ip is banned without calling the provider.
+			requireDenied(t, request("192.0.0.1", captchaToken(ethAddress)), captchaBanned)
+			err := request("192.0.0.2", captchaToken(ethAddress))
+			if tt.wantAddressBan {
+				requireDenied(t, err, captchaBanned)
+			} else if err != nil {
+				t.Errorf("Wanted the address to be funded from another ip, got %v", err)
+			}
+			if captcha.calls != tt.wantCaptchaCalls {
+				t.Errorf("Wanted the captcha provider to be called %d times, got %d", tt.wantCaptchaCalls, captcha.calls)
+			}
+		})
+	}
+}
+
+// Captcha verifier without a captcha site for the origin of any request.
+type unconfiguredCaptcha struct {
+	fakeCaptcha
+}
+
+func (unconfiguredCaptcha) verify(_ context.Context, _, origin, _ string, _ common.Address) error {
+	return fmt.Errorf("%w for origin %q", errNoCaptchaSite, origin)
+}
+
+func TestServer_RequestFunds_captchaSiteMissing(t *testing.T) {
+	srv := newTestServer(t, newSimpleRateLimiter(testRateLimits(5, 5, time.Hour)), &fakeClient{})
+	srv.captcha = unconfiguredCaptcha{}
+	srv.penalties = newCaptchaPenalties(&Config{
+		CaptchaFailuresPerIP:      1,
+		CaptchaFailuresPerAddress: 1,
+		CaptchaFailureWindow:      time.Hour,
+		CaptchaBanDuration:        time.Minute,
+		CaptchaMaxBanDuration:     time.Hour,
+	})
+	ethAddress := "0x0101010101010101010101010101010101010101"
+	for i := 0; i < 2; i++ {
+		_, err := srv.RequestFunds(requestContext("192.0.0.1"), captchaFundingRequest(ethAddress))
+		if status.Code(err) != codes.FailedPrecondition {
+			t.Fatalf("Wanted %v for a missing captcha site, got %v", codes.FailedPrecondition, err)
+		}
+	}
+	if err := srv.penalties.check("192.0.0.1", common.HexToAddress(ethAddress), time.Now()); err != nil {
+		t.Errorf("Wanted a missing captcha site not to count as a failure, got %v", err)
+	}
+}
+
+func TestServer_RequestFunds_apiKey(t *testing.T) {
+	client := &fakeClient{}
+	srv := newTestServer(t, newSimpleRateLimiter(testRateLimits(5, 5, time.Hour)), client)
+	srv.captcha = &countingCaptcha{}
+	keys, err := newAPIKeys(&Config{
+		APIKeys:      []APIKey{{Name: "ci", Hash: hashAPIKey("ci-key"), Quota: withQuota(2)}},
+		APIKeyWindow: time.Hour,
+	}, srv.rateLimiter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.apiKeys = keys
+	request := func(key string) error {
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(
+			"x-forwarded-for", "192.0.0.1",
+			apiKeyHeader, key,
+		))
+		_, err := srv.RequestFunds(ctx, &faucetpb.FundingRequest{
+			WalletAddress: "0x0101010101010101010101010101010101010101",
+		})
+		return err
+	}
+
+	// Requests with a key skip the captcha and the address cooldown.
+	for i := 0; i < 2; i++ {
+		if err := request("ci-key"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	requireDenied(t, request("ci-key"), apiKeyQuota)
+	if code := status.Code(request("wrong-key")); code != codes.Unauthenticated {
+		t.Errorf("Wanted %v for an invalid key, got %v", codes.Unauthenticated, code)
+	}
+	if calls := srv.captcha.(*countingCaptcha).calls; calls != 0 {
+		t.Errorf("Wanted the captcha to be skipped, got %d calls", calls)
+	}
+	if sent := client.numSent(); sent != 2 {
+		t.Errorf("Wanted 2 transactions, got %d", sent)
+	}
+}
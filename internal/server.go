@@ -2,23 +2,23 @@ package internal
 
 import (
 	"context"
-	"crypto/ecdsa"
 	"errors"
 	"fmt"
+	"io"
 	"math/big"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"runtime"
-	"strings"
 	"syscall"
+	"time"
 
+	"github.com/ethereum/go-ethereum"
 	"github.com/ethereum/go-ethereum/common"
-	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/ethclient"
-	"github.com/prestonvanloon/go-recaptcha"
 	faucetpb "github.com/rauljordan/eth-faucet/proto/faucet"
-	gateway "github.com/rauljordan/minimal-grpc-gateway"
 	"github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/reflection"
@@ -30,61 +30,230 @@ var (
 
 // Config for the faucet server.
 type Config struct {
-	GrpcPort          int      `mapstructure:"grpc-port"`
-	GrpcHost          string   `mapstructure:"grpc-host"`
-	HttpPort          int      `mapstructure:"http-port"`
-	HttpHost          string   `mapstructure:"http-host"`
-	AllowedOrigins    []string `mapstructure:"allowed-origins"`
-	CaptchaHost       string   `mapstructure:"captcha-host"`
-	CaptchaSecret     string   `mapstructure:"captcha-secret"`
-	CaptchaMinScore   float64  `mapstructure:"captcha-min-score"`
-	Web3Provider      string   `mapstructure:"web3-provider"`
-	PrivateKey        string   `mapstructure:"private-key"`
-	FundingAmount     string   `mapstructure:"funding-amount"`
-	GasLimit          uint64   `mapstructure:"gas-limit"`
-	IpLimitPerAddress int      `mapstructure:"ip-limit-per-address"`
-	ChainId           int64    `mapstructure:"chain-id"`
+	GrpcPort                  int           `mapstructure:"grpc-port"`
+	GrpcHost                  string        `mapstructure:"grpc-host"`
+	HttpPort                  int           `mapstructure:"http-port"`
+	HttpHost                  string        `mapstructure:"http-host"`
+	AllowedOrigins            []string      `mapstructure:"allowed-origins"`
+	MetricsHost               string        `mapstructure:"metrics-host"`
+	MetricsPort               int           `mapstructure:"metrics-port"`
+	CaptchaProvider           string        `mapstructure:"captcha-provider"`
+	CaptchaVerifyURL          string        `mapstructure:"captcha-verify-url"`
+	CaptchaHost               string        `mapstructure:"captcha-host"`
+	CaptchaSecret             string        `mapstructure:"captcha-secret"`
+	CaptchaMinScore           float64       `mapstructure:"captcha-min-score"`
+	CaptchaSites              []CaptchaSite `mapstructure:"captcha-sites"`
+	CaptchaReplayCacheSize    int           `mapstructure:"captcha-replay-cache-size"`
+	CaptchaFailuresPerIP      int           `mapstructure:"captcha-failures-per-ip"`
+	CaptchaFailuresPerAddress int           `mapstructure:"captcha-failures-per-address"`
+	CaptchaFailureWindow      time.Duration `mapstructure:"captcha-failure-window"`
+	CaptchaBanDuration        time.Duration `mapstructure:"captcha-ban-duration"`
+	CaptchaMaxBanDuration     time.Duration `mapstructure:"captcha-max-ban-duration"`
+	PowEnabled                bool          `mapstructure:"pow-enabled"`
+	PowSecret                 string        `mapstructure:"pow-secret"`
+	PowDifficulty             int           `mapstructure:"pow-difficulty"`
+	PowMaxDifficulty          int           `mapstructure:"pow-max-difficulty"`
+	PowTargetPerMinute        int           `mapstructure:"pow-target-per-minute"`
+	PowChallengeTTL           time.Duration `mapstructure:"pow-challenge-ttl"`
+	Web3Provider              string        `mapstructure:"web3-provider"`
+	PrivateKey                string        `mapstructure:"private-key"`
+	PrivateKeys               []string      `mapstructure:"private-keys"`
+	FunderStrategy            string        `mapstructure:"funder-strategy"`
+	MinFunderBalance          string        `mapstructure:"min-funder-balance"`
+	KeystorePath              string        `mapstructure:"keystore-path"`
+	KeystorePasswordFile      string        `mapstructure:"keystore-password-file"`
+	RemoteSignerURL           string        `mapstructure:"remote-signer-url"`
+	RemoteSignerAccounts      []string      `mapstructure:"remote-signer-accounts"`
+	FundingAmount             string        `mapstructure:"funding-amount"`
+	Tokens                    []Token       `mapstructure:"tokens"`
+	GasLimit                  uint64        `mapstructure:"gas-limit"`
+	TxType                    string        `mapstructure:"tx-type"`
+	MaxFeePerGas              string        `mapstructure:"max-fee-per-gas"`
+	MaxPriorityFeePerGas      string        `mapstructure:"max-priority-fee-per-gas"`
+	AsyncFunding              bool          `mapstructure:"async-funding"`
+	FundingStatusRetention    time.Duration `mapstructure:"funding-status-retention"`
+	Confirmations             int           `mapstructure:"confirmations"`
+	ReplaceAfter              time.Duration `mapstructure:"replace-after"`
+	MaxReplacementFeePerGas   string        `mapstructure:"max-replacement-fee-per-gas"`
+	MaxFundingWait            time.Duration `mapstructure:"max-funding-wait"`
+	IpLimitPerAddress         int           `mapstructure:"ip-limit-per-address"`
+	AddressLimitPerIP         int           `mapstructure:"address-limit-per-ip"`
+	AddressLimitPerSubnet     int           `mapstructure:"address-limit-per-subnet"`
+	Ipv4PrefixLength          int           `mapstructure:"ipv4-prefix-length"`
+	Ipv6PrefixLength          int           `mapstructure:"ipv6-prefix-length"`
+	TrustedProxies            int           `mapstructure:"trusted-proxies"`
+	LimitWindow               time.Duration `mapstructure:"limit-window"`
+	AddressCooldown           time.Duration `mapstructure:"address-cooldown"`
+	ChainId                   int64         `mapstructure:"chain-id"`
+	RateLimiter               string        `mapstructure:"rate-limiter"`
+	RateLimiterDBPath         string        `mapstructure:"rate-limiter-db-path"`
+	RedisURL                  string        `mapstructure:"redis-url"`
+	BudgetMaxWei              string        `mapstructure:"budget-max-wei"`
+	BudgetWindow              time.Duration `mapstructure:"budget-window"`
+	BudgetMaxTxPerMinute      int           `mapstructure:"budget-max-tx-per-minute"`
+	AllowlistPath             string        `mapstructure:"allowlist-path"`
+	DenylistPath              string        `mapstructure:"denylist-path"`
+	APIKeys                   []APIKey      `mapstructure:"api-keys"`
+	APIKeysPath               string        `mapstructure:"api-keys-path"`
+	APIKeyQuota               int           `mapstructure:"api-key-quota"`
+	APIKeyWindow              time.Duration `mapstructure:"api-key-window"`
+}
+
+// Subset of the Ethereum client used by the faucet server.
+type ethClient interface {
+	PendingNonceAt(ctx context.Context, account common.Address) (uint64, error)
+	SendTransaction(ctx context.Context, tx *types.Transaction) error
+	TransactionByHash(ctx context.Context, hash common.Hash) (tx *types.Transaction, isPending bool, err error)
+	TransactionReceipt(ctx context.Context, txHash common.Hash) (*types.Receipt, error)
+	BlockNumber(ctx context.Context) (uint64, error)
+	BalanceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (*big.Int, error)
+	HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error)
+	SuggestGasTipCap(ctx context.Context) (*big.Int, error)
+	SuggestGasPrice(ctx context.Context) (*big.Int, error)
+	CallContract(ctx context.Context, call ethereum.CallMsg, blockNumber *big.Int) ([]byte, error)
+	EstimateGas(ctx context.Context, call ethereum.CallMsg) (uint64, error)
 }
 
 // Server capable of funding requests for faucet ETH via gRPC and REST HTTP.
 type Server struct {
 	faucetpb.UnimplementedFaucetServer
-	cfg           *Config
-	captcha       recaptcha.Recaptcha
-	client        *ethclient.Client
-	funder        common.Address
-	pk            *ecdsa.PrivateKey
-	fundingAmount *big.Int
-	rateLimiter   rateLimiter
+	cfg                     *Config
+	captcha                 captchaVerifier
+	pow                     *powChallenger
+	usedTokens              usedTokenStore
+	penalties               *captchaPenalties
+	apiKeys                 *apiKeys
+	client                  ethClient
+	funders                 *funderPool
+	fundingAmount           *big.Int
+	maxFeePerGas            *big.Int
+	maxPriorityFeePerGas    *big.Int
+	maxReplacementFeePerGas *big.Int
+	rateLimiter             rateLimiter
+	tokens                  map[string]*erc20Token
+	budget                  *spendingBudget
+	accessLists             *accessLists
+	fundingRequests         *fundingRequests
+	pollInterval            time.Duration
+	shutdownCtx             context.Context
+	shutdown                context.CancelFunc
 }
 
 // NewServer initializes the server from configuration values.
 func NewServer(cfg *Config) (*Server, error) {
-	privKeyHex := cfg.PrivateKey
-	if strings.HasPrefix(privKeyHex, "0x") {
-		privKeyHex = privKeyHex[2:]
-	}
-	pk, err := crypto.HexToECDSA(privKeyHex)
+	signers, err := newFunderSigners(context.Background(), cfg)
 	if err != nil {
-		return nil, fmt.Errorf("could not parse funder private key: %v", err)
+		return nil, err
+	}
+	switch cfg.FunderStrategy {
+	case "", mostBalanceStrategy, fewestPendingStrategy:
+	default:
+		return nil, fmt.Errorf("unknown funder strategy %q", cfg.FunderStrategy)
+	}
+	minFunderBalance := new(big.Int)
+	if cfg.MinFunderBalance != "" {
+		if _, ok := minFunderBalance.SetString(cfg.MinFunderBalance, 10); !ok {
+			return nil, errors.New("could not set min funder balance")
+		}
 	}
 	fundingAmount, ok := new(big.Int).SetString(cfg.FundingAmount, 10)
 	if !ok {
 		return nil, errors.New("could not set funding amount")
 	}
+	switch cfg.TxType {
+	case "", autoTxType, dynamicFeeTxType, legacyTxType:
+	default:
+		return nil, fmt.Errorf("unknown transaction type %q", cfg.TxType)
+	}
+	maxFeePerGas, ok := new(big.Int).SetString(cfg.MaxFeePerGas, 10)
+	if !ok {
+		return nil, errors.New("could not set max fee per gas")
+	}
+	maxPriorityFeePerGas, ok := new(big.Int).SetString(cfg.MaxPriorityFeePerGas, 10)
+	if !ok {
+		return nil, errors.New("could not set max priority fee per gas")
+	}
+	maxReplacementFeePerGas, ok := new(big.Int).SetString(cfg.MaxReplacementFeePerGas, 10)
+	if !ok {
+		return nil, errors.New("could not set max replacement fee per gas")
+	}
+	if cfg.Confirmations < 1 {
+		return nil, fmt.Errorf("invalid number of confirmations %d", cfg.Confirmations)
+	}
+	budgetMaxWei := new(big.Int)
+	if cfg.BudgetMaxWei != "" {
+		if _, ok := budgetMaxWei.SetString(cfg.BudgetMaxWei, 10); !ok {
+			return nil, errors.New("could not set spending budget")
+		}
+	}
+	// A budget smaller than a single funding would trip on every request.
+	if budgetMaxWei.Sign() > 0 && fundingAmount.Cmp(budgetMaxWei) > 0 {
+		return nil, fmt.Errorf("funding amount %s exceeds the spending budget of %s wei", fundingAmount, budgetMaxWei)
+	}
 	client, err := ethclient.DialContext(context.Background(), cfg.Web3Provider)
 	if err != nil {
 		return nil, fmt.Errorf("could not dial %s: %w", cfg.Web3Provider, err)
 	}
-	funder := crypto.PubkeyToAddress(pk.PublicKey)
+	limiter, err := newRateLimiter(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("could not initialize rate limiter: %w", err)
+	}
+	usedTokens, err := newUsedTokenStore(cfg, limiter)
+	if err != nil {
+		return nil, fmt.Errorf("could not initialize used tokens: %w", err)
+	}
+	tokens, err := newTokens(cfg, limiter)
+	if err != nil {
+		return nil, fmt.Errorf("could not initialize tokens: %w", err)
+	}
+	// Captchas are optional when requests can be verified with proof of work.
+	var captcha captchaVerifier
+	if cfg.CaptchaSecret != "" || len(cfg.CaptchaSites) > 0 || !cfg.PowEnabled {
+		captcha, err = newCaptchaVerifier(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("could not initialize captcha verifier: %w", err)
+		}
+	}
+	if cfg.CaptchaReplayCacheSize <= 0 {
+		return nil, fmt.Errorf("invalid captcha replay cache size %d", cfg.CaptchaReplayCacheSize)
+	}
+	var pow *powChallenger
+	if cfg.PowEnabled {
+		pow, err = newPowChallenger(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("could not initialize proof-of-work challenger: %w", err)
+		}
+	}
+	lists, err := newAccessLists(cfg.AllowlistPath, cfg.DenylistPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not initialize access lists: %w", err)
+	}
+	keys, err := newAPIKeys(cfg, limiter)
+	if err != nil {
+		return nil, fmt.Errorf("could not initialize api keys: %w", err)
+	}
+	shutdownCtx, shutdown := context.WithCancel(context.Background())
 	return &Server{
-		cfg:           cfg,
-		client:        client,
-		funder:        funder,
-		captcha:       recaptcha.Recaptcha{RecaptchaPrivateKey: cfg.CaptchaSecret},
-		pk:            pk,
-		fundingAmount: fundingAmount,
-		rateLimiter:   newSimpleRateLimiter(cfg.IpLimitPerAddress),
+		cfg:                     cfg,
+		client:                  client,
+		captcha:                 captcha,
+		pow:                     pow,
+		usedTokens:              usedTokens,
+		penalties:               newCaptchaPenalties(cfg),
+		apiKeys:                 keys,
+		fundingAmount:           fundingAmount,
+		funders:                 newFunderPool(client, signers, cfg.FunderStrategy, minFunderBalance, fundingAmount),
+		maxFeePerGas:            maxFeePerGas,
+		maxPriorityFeePerGas:    maxPriorityFeePerGas,
+		maxReplacementFeePerGas: maxReplacementFeePerGas,
+		rateLimiter:             limiter,
+		tokens:                  tokens,
+		budget:                  newSpendingBudget(budgetMaxWei, cfg.BudgetWindow, cfg.BudgetMaxTxPerMinute),
+		accessLists:             lists,
+		fundingRequests:         newFundingRequests(cfg.FundingStatusRetention),
+		pollInterval:            time.Second,
+		shutdownCtx:             shutdownCtx,
+		shutdown:                shutdown,
 	}, nil
 }
 
@@ -98,9 +267,17 @@ func (s *Server) Start() {
 		"chainID": s.cfg.ChainId,
 	}).Info("Initializing faucet server")
 
-	// Query the funds left in the funder's account.
+	// Query the funds left in the funders' accounts.
 	s.queryFundsLeft(ctx)
 
+	// Start handing out nonces from each funder's pending nonce. If the node
+	// cannot be reached yet, the nonce manager syncs on the first request.
+	for _, f := range s.funders.funders {
+		if err := f.nonces.sync(ctx); err != nil {
+			log.WithError(err).WithField("funder", f.address.Hex()).Error("Could not sync funder nonce")
+		}
+	}
+
 	// Initialize and register gRPC handlers.
 	grpcServer := s.initializeGRPCServer()
 
@@ -119,17 +296,53 @@ func (s *Server) Start() {
 
 	// Check IP addresses and reset their max request count over time.
 	go s.rateLimiter.refreshLimits(ctx)
+	for _, t := range s.tokens {
+		go t.rateLimiter.refreshLimits(ctx)
+	}
+	for _, k := range s.apiKeys.keys {
+		go k.rateLimiter.refreshLimits(ctx)
+	}
+
+	// Resume the faucet if an operator signals it after the spending budget tripped.
+	go s.listenForResume(ctx)
+
+	// Reload the allowlist and denylist whenever they change.
+	go s.accessLists.watch(ctx)
+
+	// Forget used captcha tokens and proof-of-work challenges once they expire.
+	go s.usedTokens.refresh(ctx)
+
+	// Forget clients who stopped failing captchas over time.
+	go s.penalties.refresh(ctx)
+
+	// Forget the status of finished funding requests over time.
+	go s.fundingRequests.refresh(ctx)
+
+	// Serve prometheus metrics on their own port, if enabled.
+	var metricsSrv *http.Server
+	if s.cfg.MetricsPort > 0 {
+		metricsAddress := fmt.Sprintf("%s:%d", s.cfg.MetricsHost, s.cfg.MetricsPort)
+		metricsSrv = newMetricsServer(metricsAddress)
+		go func() {
+			log.Infof("Starting metrics server %s", metricsAddress)
+			if err := metricsSrv.ListenAndServe(); err != http.ErrServerClosed {
+				log.WithError(err).Fatal("Stopped metrics server")
+			}
+		}()
+	}
 
 	// Start a gRPC Gateway to serve http JSON requests.
 	gatewayAddress := fmt.Sprintf("%s:%d", s.cfg.HttpHost, s.cfg.HttpPort)
-	gatewaySrv := gateway.New(ctx, &gateway.Config{
-		GatewayAddress:      gatewayAddress,
-		RemoteAddress:       grpcAddress,
-		AllowedOrigins:      s.cfg.AllowedOrigins,
-		EndpointsToRegister: []gateway.RegistrationFunc{faucetpb.RegisterFaucetHandlerFromEndpoint},
-	})
-	log.Infof("Starting JSON http server %s", gatewayAddress)
-	gatewaySrv.Start()
+	gatewaySrv, err := s.initializeGateway(ctx, gatewayAddress, grpcAddress)
+	if err != nil {
+		log.WithError(err).Fatal("Could not initialize JSON http server")
+	}
+	go func() {
+		log.Infof("Starting JSON http server %s", gatewayAddress)
+		if err := gatewaySrv.ListenAndServe(); err != http.ErrServerClosed {
+			log.WithError(err).Fatal("Stopped JSON http server")
+		}
+	}()
 
 	// Listen for any process interrupts.
 	stop := make(chan struct{})
@@ -139,25 +352,62 @@ func (s *Server) Start() {
 		defer signal.Stop(sigc)
 		<-sigc
 		logrus.Info("Got interrupt, shutting down...")
+		// Stop waiting for funding transactions, their requests keep holding their limits.
+		s.shutdown()
+		if err := gatewaySrv.Shutdown(ctx); err != nil {
+			log.WithError(err).Error("Could not shut down JSON http server")
+		}
+		if metricsSrv != nil {
+			if err := metricsSrv.Shutdown(ctx); err != nil {
+				log.WithError(err).Error("Could not shut down metrics server")
+			}
+		}
 		grpcServer.GracefulStop()
 		stop <- struct{}{}
 	}()
 
 	// Wait for stop channel to be closed.
 	<-stop
+
+	// Persistent rate limiters hold on to their backing store until shutdown.
+	if closer, ok := s.rateLimiter.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			log.WithError(err).Error("Could not close rate limiter")
+		}
+	}
 }
 
-// Query the funds left in the faucet account and log them to the uer.
-func (s *Server) queryFundsLeft(ctx context.Context) {
-	bal, err := s.client.BalanceAt(ctx, s.funder, nil)
-	if err != nil {
-		log.WithError(err).Fatalf("Could not retrieve funder's current balance")
+// Resumes a paused faucet whenever one of the resume signals is received.
+func (s *Server) listenForResume(ctx context.Context) {
+	if len(resumeSignals) == 0 {
+		return
+	}
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, resumeSignals...)
+	defer signal.Stop(sigc)
+	for {
+		select {
+		case <-sigc:
+			s.budget.resume()
+		case <-ctx.Done():
+			return
+		}
 	}
+}
 
-	log.WithFields(logrus.Fields{
-		"fundsInWei": bal,
-		"publicKey":  s.funder.Hex(),
-	}).Info("Funder account details")
+// Query the funds left in the faucet accounts and log them to the uer.
+func (s *Server) queryFundsLeft(ctx context.Context) {
+	for _, f := range s.funders.funders {
+		bal, err := s.client.BalanceAt(ctx, f.address, nil)
+		if err != nil {
+			log.WithError(err).Fatalf("Could not retrieve funder's current balance")
+		}
+
+		log.WithFields(logrus.Fields{
+			"fundsInWei": bal,
+			"publicKey":  f.address.Hex(),
+		}).Info("Funder account details")
+	}
 }
 
 // Initialize a gRPC server and register handlers.
@@ -0,0 +1,15 @@
+//go:build !windows
+// +build !windows
+
+package internal
+
+import (
+	"os"
+	"syscall"
+)
+
+// Signals an operator sends to resume a paused faucet.
+var resumeSignals = []os.Signal{syscall.SIGUSR1}
+
+// Signals an operator sends to reload the access lists.
+var reloadSignals = []os.Signal{syscall.SIGHUP}
@@ -0,0 +1,13 @@
+//go:build windows
+// +build windows
+
+package internal
+
+import "os"
+
+// Windows has no user-defined signals, so a paused faucet resumes once the
+// exhausted budget window resets.
+var resumeSignals []os.Signal
+
+// Access lists on Windows are only reloaded when their files change.
+var reloadSignals []os.Signal
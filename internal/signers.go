@@ -0,0 +1,224 @@
+package internal
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// Signers sign the transactions of a funder account, either with a key held by
+// the faucet or by asking an external signer holding the key.
+type txSigner interface {
+	account() common.Address
+	signTx(ctx context.Context, tx *types.Transaction, chainID *big.Int) (*types.Transaction, error)
+}
+
+// Signs with a private key held in memory, parsed from a hex string or
+// decrypted from a keystore file.
+type keySigner struct {
+	pk *ecdsa.PrivateKey
+}
+
+func (s *keySigner) account() common.Address {
+	return crypto.PubkeyToAddress(s.pk.PublicKey)
+}
+
+func (s *keySigner) signTx(_ context.Context, tx *types.Transaction, chainID *big.Int) (*types.Transaction, error) {
+	return types.SignTx(tx, types.LatestSignerForChainID(chainID), s.pk)
+}
+
+// Signs with an external signer, such as Clef or Web3Signer, over its
+// eth_signTransaction JSON-RPC API.
+type remoteSigner struct {
+	client  *rpc.Client
+	address common.Address
+}
+
+// Arguments of eth_signTransaction.
+type signTxArgs struct {
+	From                 common.Address  `json:"from"`
+	To                   *common.Address `json:"to,omitempty"`
+	Gas                  hexutil.Uint64  `json:"gas"`
+	GasPrice             *hexutil.Big    `json:"gasPrice,omitempty"`
+	MaxFeePerGas         *hexutil.Big    `json:"maxFeePerGas,omitempty"`
+	MaxPriorityFeePerGas *hexutil.Big    `json:"maxPriorityFeePerGas,omitempty"`
+	Value                *hexutil.Big    `json:"value"`
+	Nonce                hexutil.Uint64  `json:"nonce"`
+	Data                 hexutil.Bytes   `json:"data"`
+	ChainID              *hexutil.Big    `json:"chainId,omitempty"`
+}
+
+func (s *remoteSigner) account() common.Address {
+	return s.address
+}
+
+func (s *remoteSigner) signTx(ctx context.Context, tx *types.Transaction, chainID *big.Int) (*types.Transaction, error) {
+	args := signTxArgs{
+		From:    s.address,
+		To:      tx.To(),
+		Gas:     hexutil.Uint64(tx.Gas()),
+		Value:   (*hexutil.Big)(tx.Value()),
+		Nonce:   hexutil.Uint64(tx.Nonce()),
+		Data:    tx.Data(),
+		ChainID: (*hexutil.Big)(chainID),
+	}
+	if tx.Type() == types.DynamicFeeTxType {
+		args.MaxFeePerGas = (*hexutil.Big)(tx.GasFeeCap())
+		args.MaxPriorityFeePerGas = (*hexutil.Big)(tx.GasTipCap())
+	} else {
+		args.GasPrice = (*hexutil.Big)(tx.GasPrice())
+	}
+	// Clef answers with the raw transaction and its decoded fields, while
+	// Web3Signer answers with just the raw transaction.
+	var result json.RawMessage
+	if err := s.client.CallContext(ctx, &result, "eth_signTransaction", args); err != nil {
+		return nil, fmt.Errorf("remote signer could not sign tx: %w", err)
+	}
+	var raw hexutil.Bytes
+	if err := json.Unmarshal(result, &raw); err != nil {
+		var clefResult struct {
+			Raw hexutil.Bytes `json:"raw"`
+		}
+		if err := json.Unmarshal(result, &clefResult); err != nil {
+			return nil, fmt.Errorf("could not decode remote signer response: %w", err)
+		}
+		raw = clefResult.Raw
+	}
+	signed := new(types.Transaction)
+	if err := signed.UnmarshalBinary(raw); err != nil {
+		return nil, fmt.Errorf("could not decode signed tx: %w", err)
+	}
+
+	// Only send what was asked to be signed, by the account it was asked of.
+	signer := types.LatestSignerForChainID(chainID)
+	if signed.Type() != tx.Type() || signer.Hash(signed) != signer.Hash(tx) {
+		return nil, errors.New("remote signer signed a different tx")
+	}
+	sender, err := types.Sender(signer, signed)
+	if err != nil {
+		return nil, fmt.Errorf("could not recover signer of tx: %w", err)
+	}
+	if sender != s.address {
+		return nil, fmt.Errorf("remote signer signed tx with %s instead of %s", sender.Hex(), s.address.Hex())
+	}
+	return signed, nil
+}
+
+// Initializes the signers of every configured funder account: hex private
+// keys, an encrypted keystore file and accounts held by a remote signer.
+// Accounts configured more than once are only used once.
+func newFunderSigners(ctx context.Context, cfg *Config) ([]txSigner, error) {
+	var signers []txSigner
+	hexKeys := cfg.PrivateKeys
+	if cfg.PrivateKey != "" {
+		hexKeys = append([]string{cfg.PrivateKey}, hexKeys...)
+	}
+	keys, err := parseFunderKeys(hexKeys)
+	if err != nil {
+		return nil, err
+	}
+	for _, pk := range keys {
+		signers = append(signers, &keySigner{pk: pk})
+	}
+	if cfg.KeystorePath != "" {
+		pk, err := loadKeystore(cfg.KeystorePath, cfg.KeystorePasswordFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load funder keystore: %w", err)
+		}
+		signers = append(signers, &keySigner{pk: pk})
+	}
+	if cfg.RemoteSignerURL != "" {
+		remote, err := newRemoteSigners(ctx, cfg.RemoteSignerURL, cfg.RemoteSignerAccounts)
+		if err != nil {
+			return nil, fmt.Errorf("could not initialize remote signer: %w", err)
+		}
+		signers = append(signers, remote...)
+	}
+
+	var unique []txSigner
+	seen := make(map[common.Address]bool)
+	for _, s := range signers {
+		if seen[s.account()] {
+			continue
+		}
+		seen[s.account()] = true
+		unique = append(unique, s)
+	}
+	if len(unique) == 0 {
+		return nil, errors.New("no funder account configured")
+	}
+	return unique, nil
+}
+
+// Parses the hex private keys of funder accounts.
+func parseFunderKeys(hexKeys []string) ([]*ecdsa.PrivateKey, error) {
+	keys := make([]*ecdsa.PrivateKey, len(hexKeys))
+	for i, hexKey := range hexKeys {
+		pk, err := crypto.HexToECDSA(strings.TrimPrefix(hexKey, "0x"))
+		if err != nil {
+			return nil, fmt.Errorf("could not parse funder private key: %v", err)
+		}
+		keys[i] = pk
+	}
+	return keys, nil
+}
+
+// Decrypts the private key in a go-ethereum keystore file with the password
+// read from the password file, ignoring its trailing newline.
+func loadKeystore(path, passwordFile string) (*ecdsa.PrivateKey, error) {
+	keyJSON, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read keystore: %w", err)
+	}
+	var password string
+	if passwordFile != "" {
+		b, err := ioutil.ReadFile(passwordFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read keystore password: %w", err)
+		}
+		password = strings.TrimRight(string(b), "\r\n")
+	}
+	key, err := keystore.DecryptKey(keyJSON, password)
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt keystore: %w", err)
+	}
+	return key.PrivateKey, nil
+}
+
+// Connects to a remote signer, signing with the given accounts or else with
+// every account it lists.
+func newRemoteSigners(ctx context.Context, url string, accounts []string) ([]txSigner, error) {
+	client, err := rpc.DialContext(ctx, url)
+	if err != nil {
+		return nil, fmt.Errorf("could not dial %s: %w", url, err)
+	}
+	var addresses []common.Address
+	if len(accounts) == 0 {
+		if err := client.CallContext(ctx, &addresses, "eth_accounts"); err != nil {
+			return nil, fmt.Errorf("could not list remote signer accounts: %w", err)
+		}
+	}
+	for _, account := range accounts {
+		if !common.IsHexAddress(account) {
+			return nil, fmt.Errorf("invalid remote signer account %q", account)
+		}
+		addresses = append(addresses, common.HexToAddress(account))
+	}
+	signers := make([]txSigner, len(addresses))
+	for i, address := range addresses {
+		signers[i] = &remoteSigner{client: client, address: address}
+	}
+	return signers, nil
+}
@@ -0,0 +1,254 @@
+package internal
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"io/ioutil"
+	"math/big"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// Remote signer answering eth_signTransaction like Clef, or like Web3Signer
+// with just the raw transaction. A tampering signer signs more value than it
+// was asked to.
+type fakeRemoteSigner struct {
+	pk         *ecdsa.PrivateKey
+	web3signer bool
+	tamper     bool
+}
+
+func (s *fakeRemoteSigner) Accounts() []common.Address {
+	return []common.Address{crypto.PubkeyToAddress(s.pk.PublicKey)}
+}
+
+func (s *fakeRemoteSigner) SignTransaction(args signTxArgs) (interface{}, error) {
+	value := (*big.Int)(args.Value)
+	if s.tamper {
+		value = new(big.Int).Add(value, big.NewInt(1))
+	}
+	var tx *types.Transaction
+	if args.MaxFeePerGas != nil {
+		tx = types.NewTx(&types.DynamicFeeTx{
+			ChainID:   (*big.Int)(args.ChainID),
+			Nonce:     uint64(args.Nonce),
+			GasTipCap: (*big.Int)(args.MaxPriorityFeePerGas),
+			GasFeeCap: (*big.Int)(args.MaxFeePerGas),
+			Gas:       uint64(args.Gas),
+			To:        args.To,
+			Value:     value,
+			Data:      args.Data,
+		})
+	} else {
+		tx = types.NewTx(&types.LegacyTx{
+			Nonce:    uint64(args.Nonce),
+			GasPrice: (*big.Int)(args.GasPrice),
+			Gas:      uint64(args.Gas),
+			To:       args.To,
+			Value:    value,
+			Data:     args.Data,
+		})
+	}
+	signed, err := types.SignTx(tx, types.LatestSignerForChainID((*big.Int)(args.ChainID)), s.pk)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := signed.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	if s.web3signer {
+		return hexutil.Bytes(raw), nil
+	}
+	return map[string]interface{}{"raw": hexutil.Bytes(raw), "tx": signed}, nil
+}
+
+func newFakeRemoteSigner(t *testing.T, signer *fakeRemoteSigner) string {
+	srv := rpc.NewServer()
+	if err := srv.RegisterName("eth", signer); err != nil {
+		t.Fatal(err)
+	}
+	httpSrv := httptest.NewServer(srv)
+	t.Cleanup(func() {
+		httpSrv.Close()
+		srv.Stop()
+	})
+	return httpSrv.URL
+}
+
+func Test_remoteSigner_signTx(t *testing.T) {
+	pk, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	account := crypto.PubkeyToAddress(pk.PublicKey)
+	to := common.HexToAddress("0x0101010101010101010101010101010101010101")
+	chainID := big.NewInt(5)
+	txs := map[string]*types.Transaction{
+		"dynamic": types.NewTx(&types.DynamicFeeTx{
+			ChainID:   chainID,
+			Nonce:     3,
+			GasTipCap: big.NewInt(params.GWei),
+			GasFeeCap: big.NewInt(3 * params.GWei),
+			Gas:       21000,
+			To:        &to,
+			Value:     big.NewInt(params.Ether),
+		}),
+		"legacy": types.NewTx(&types.LegacyTx{
+			Nonce:    3,
+			GasPrice: big.NewInt(params.GWei),
+			Gas:      21000,
+			To:       &to,
+			Value:    big.NewInt(params.Ether),
+		}),
+	}
+	tests := []struct {
+		name     string
+		signer   *fakeRemoteSigner
+		accounts []string
+		wantErr  string
+	}{
+		{name: "clef", signer: &fakeRemoteSigner{pk: pk}},
+		{name: "web3signer", signer: &fakeRemoteSigner{pk: pk, web3signer: true}},
+		{name: "configured_account", signer: &fakeRemoteSigner{pk: pk}, accounts: []string{account.Hex()}},
+		{name: "tampered_tx", signer: &fakeRemoteSigner{pk: pk, tamper: true}, wantErr: "different tx"},
+		{
+			name:     "wrong_account",
+			signer:   &fakeRemoteSigner{pk: pk},
+			accounts: []string{"0x0202020202020202020202020202020202020202"},
+			wantErr:  "instead of",
+		},
+	}
+	for _, tt := range tests {
+		for txType, tx := range txs {
+			t.Run(tt.name+"_"+txType, func(t *testing.T) {
+				url := newFakeRemoteSigner(t, tt.signer)
+				signers, err := newRemoteSigners(context.Background(), url, tt.accounts)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(signers) != 1 {
+					t.Fatalf("Wanted 1 remote signer, got %d", len(signers))
+				}
+				signed, err := signers[0].signTx(context.Background(), tx, chainID)
+				if tt.wantErr != "" {
+					if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+						t.Errorf("Wanted error containing %q, got %v", tt.wantErr, err)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				sender, err := types.Sender(types.LatestSignerForChainID(chainID), signed)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if sender != account || signed.Type() != tx.Type() || signed.Nonce() != tx.Nonce() {
+					t.Errorf("Wanted tx signed by %s, got %v signed by %s", account.Hex(), signed, sender.Hex())
+				}
+			})
+		}
+	}
+}
+
+func Test_loadKeystore(t *testing.T) {
+	dir := t.TempDir()
+	pk, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks := keystore.NewKeyStore(filepath.Join(dir, "keys"), keystore.LightScryptN, keystore.LightScryptP)
+	acct, err := ks.ImportECDSA(pk, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	passwordFile := filepath.Join(dir, "password")
+	if err := ioutil.WriteFile(passwordFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	wrongPasswordFile := filepath.Join(dir, "wrong")
+	if err := ioutil.WriteFile(wrongPasswordFile, []byte("guess"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := loadKeystore(acct.URL.Path, passwordFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.Equal(pk) {
+		t.Error("Wanted the key stored in the keystore")
+	}
+	if _, err := loadKeystore(acct.URL.Path, wrongPasswordFile); err == nil {
+		t.Error("Wanted wrong password to fail")
+	}
+	if _, err := loadKeystore(filepath.Join(dir, "missing"), passwordFile); err == nil {
+		t.Error("Wanted missing keystore to fail")
+	}
+}
+
+func Test_newFunderSigners(t *testing.T) {
+	keys := make([]*ecdsa.PrivateKey, 3)
+	for i := range keys {
+		pk, err := crypto.GenerateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[i] = pk
+	}
+	hexKey := func(pk *ecdsa.PrivateKey) string {
+		return hexutil.Encode(crypto.FromECDSA(pk))
+	}
+	dir := t.TempDir()
+	ks := keystore.NewKeyStore(filepath.Join(dir, "keys"), keystore.LightScryptN, keystore.LightScryptP)
+	acct, err := ks.ImportECDSA(keys[2], "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote := newFakeRemoteSigner(t, &fakeRemoteSigner{pk: keys[1]})
+
+	signers, err := newFunderSigners(context.Background(), &Config{
+		PrivateKey:      hexKey(keys[0]),
+		PrivateKeys:     []string{strings.TrimPrefix(hexKey(keys[1]), "0x"), hexKey(keys[0])},
+		KeystorePath:    acct.URL.Path,
+		RemoteSignerURL: remote,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Accounts configured more than once are only used once.
+	var got []common.Address
+	for _, s := range signers {
+		got = append(got, s.account())
+	}
+	want := []common.Address{
+		crypto.PubkeyToAddress(keys[0].PublicKey),
+		crypto.PubkeyToAddress(keys[1].PublicKey),
+		crypto.PubkeyToAddress(keys[2].PublicKey),
+	}
+	if len(got) != len(want) {
+		t.Fatalf("Wanted funders %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Wanted funder %s, got %s", want[i].Hex(), got[i].Hex())
+		}
+	}
+
+	if _, err := newFunderSigners(context.Background(), &Config{PrivateKey: "0xnotakey"}); err == nil {
+		t.Error("Wanted invalid key to fail")
+	}
+	if _, err := newFunderSigners(context.Background(), &Config{}); err == nil {
+		t.Error("Wanted missing funders to fail")
+	}
+}
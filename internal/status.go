@@ -0,0 +1,42 @@
+package internal
+
+import (
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+const errorDomain = "faucet"
+
+// Builds the status of a denied request carrying a google.rpc.ErrorInfo detail
+// with the reason for the denial and, when it is known when the request would
+// be allowed again, a google.rpc.RetryInfo detail.
+func deniedStatus(code codes.Code, msg, reason string, resetAt time.Time) *status.Status {
+	st := status.New(code, msg)
+	info := &errdetails.ErrorInfo{
+		Reason: reason,
+		Domain: errorDomain,
+	}
+	if resetAt.IsZero() {
+		return withDetails(st, info)
+	}
+	info.Metadata = map[string]string{"resetAt": resetAt.UTC().Format(time.RFC3339)}
+	retryDelay := time.Until(resetAt)
+	if retryDelay < 0 {
+		retryDelay = 0
+	}
+	return withDetails(st, info, &errdetails.RetryInfo{RetryDelay: durationpb.New(retryDelay)})
+}
+
+func withDetails(st *status.Status, details ...proto.Message) *status.Status {
+	detailed, err := st.WithDetails(details...)
+	if err != nil {
+		log.WithError(err).Error("Could not attach details to status")
+		return st
+	}
+	return detailed
+}
@@ -0,0 +1,251 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Asset requested by funding requests which leave the asset empty.
+const ethAsset = "eth"
+
+var errTransferRefused = errors.New("token refused the transfer")
+
+// Token configures an ERC-20 token dispensed alongside ETH, requested by its
+// name. The amount is in base units of the token. Limits left out use the
+// faucet's limits, and limits set to 0 are disabled for the token, but either
+// are counted separately from the limits of ETH and of every other token.
+type Token struct {
+	Name                  string         `mapstructure:"name"`
+	Address               string         `mapstructure:"address"`
+	Amount                string         `mapstructure:"amount"`
+	AddressCooldown       *time.Duration `mapstructure:"address-cooldown"`
+	LimitWindow           *time.Duration `mapstructure:"limit-window"`
+	IpLimitPerAddress     *int           `mapstructure:"ip-limit-per-address"`
+	AddressLimitPerIP     *int           `mapstructure:"address-limit-per-ip"`
+	AddressLimitPerSubnet *int           `mapstructure:"address-limit-per-subnet"`
+}
+
+// Functions of the ERC-20 standard called by the faucet.
+const erc20ABIJSON = `[
+	{"type":"function","name":"transfer","inputs":[{"name":"to","type":"address"},{"name":"value","type":"uint256"}],"outputs":[{"name":"","type":"bool"}]},
+	{"type":"function","name":"balanceOf","stateMutability":"view","inputs":[{"name":"account","type":"address"}],"outputs":[{"name":"","type":"uint256"}]},
+	{"type":"function","name":"decimals","stateMutability":"view","inputs":[],"outputs":[{"name":"","type":"uint8"}]},
+	{"type":"function","name":"symbol","stateMutability":"view","inputs":[],"outputs":[{"name":"","type":"string"}]}
+]`
+
+var erc20ABI = mustParseABI(erc20ABIJSON)
+
+func mustParseABI(abiJSON string) abi.ABI {
+	parsed, err := abi.JSON(strings.NewReader(abiJSON))
+	if err != nil {
+		panic(err)
+	}
+	return parsed
+}
+
+// ERC-20 token dispensed by the faucet with its own amount and rate limiter.
+// Its symbol and decimals are read from the contract the first time they are
+// needed.
+type erc20Token struct {
+	name        string
+	address     common.Address
+	amount      *big.Int
+	rateLimiter rateLimiter
+
+	mutex    sync.Mutex
+	loaded   bool
+	symbol   string
+	decimals uint8
+}
+
+// Initializes the configured tokens by name, with rate limiters scoped to each
+// token on the backend of the faucet's rate limiter.
+func newTokens(cfg *Config, base rateLimiter) (map[string]*erc20Token, error) {
+	tokens := make(map[string]*erc20Token, len(cfg.Tokens))
+	for _, t := range cfg.Tokens {
+		name := strings.ToLower(t.Name)
+		if name == "" || name == ethAsset {
+			return nil, fmt.Errorf("invalid token name %q", t.Name)
+		}
+		if _, ok := tokens[name]; ok {
+			return nil, fmt.Errorf("token %s configured more than once", name)
+		}
+		if !common.IsHexAddress(t.Address) {
+			return nil, fmt.Errorf("invalid address %q of token %s", t.Address, name)
+		}
+		amount, ok := new(big.Int).SetString(t.Amount, 10)
+		if !ok || amount.Sign() <= 0 {
+			return nil, fmt.Errorf("invalid amount %q of token %s", t.Amount, name)
+		}
+		limits := newRateLimits(t.limitsConfig(cfg))
+		limits.scope = "token:" + name
+		limiter, err := newScopedRateLimiter(base, limits)
+		if err != nil {
+			return nil, fmt.Errorf("could not initialize rate limiter of token %s: %w", name, err)
+		}
+		tokens[name] = &erc20Token{
+			name:        name,
+			address:     common.HexToAddress(t.Address),
+			amount:      amount,
+			rateLimiter: limiter,
+		}
+	}
+	return tokens, nil
+}
+
+// Copy of the faucet configuration with the limits set for the token.
+func (t Token) limitsConfig(cfg *Config) *Config {
+	c := *cfg
+	if t.AddressCooldown != nil {
+		c.AddressCooldown = *t.AddressCooldown
+	}
+	if t.LimitWindow != nil {
+		c.LimitWindow = *t.LimitWindow
+	}
+	if t.IpLimitPerAddress != nil {
+		c.IpLimitPerAddress = *t.IpLimitPerAddress
+	}
+	if t.AddressLimitPerIP != nil {
+		c.AddressLimitPerIP = *t.AddressLimitPerIP
+	}
+	if t.AddressLimitPerSubnet != nil {
+		c.AddressLimitPerSubnet = *t.AddressLimitPerSubnet
+	}
+	return &c
+}
+
+// Reads the symbol and decimals of the token from its contract, once they were
+// read successfully.
+func (t *erc20Token) metadata(ctx context.Context, client ethClient) (string, uint8, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.loaded {
+		return t.symbol, t.decimals, nil
+	}
+	out, err := t.call(ctx, client, "decimals")
+	if err != nil {
+		return "", 0, err
+	}
+	decimals, ok := out[0].(uint8)
+	if !ok {
+		return "", 0, fmt.Errorf("unexpected decimals %v", out[0])
+	}
+	symbol, err := t.readSymbol(ctx, client)
+	if err != nil {
+		return "", 0, err
+	}
+	t.symbol, t.decimals, t.loaded = symbol, decimals, true
+	return symbol, decimals, nil
+}
+
+// Some early tokens return their symbol as a bytes32 instead of a string.
+func (t *erc20Token) readSymbol(ctx context.Context, client ethClient) (string, error) {
+	res, err := t.callRaw(ctx, client, "symbol")
+	if err != nil {
+		return "", err
+	}
+	if out, err := erc20ABI.Unpack("symbol", res); err == nil {
+		if symbol, ok := out[0].(string); ok {
+			return symbol, nil
+		}
+	}
+	if len(res) == common.HashLength {
+		return strings.TrimRight(string(res), "\x00"), nil
+	}
+	return "", errors.New("could not decode symbol")
+}
+
+// Balance of the token held by the account.
+func (t *erc20Token) balanceOf(ctx context.Context, client ethClient, account common.Address) (*big.Int, error) {
+	out, err := t.call(ctx, client, "balanceOf", account)
+	if err != nil {
+		return nil, err
+	}
+	bal, ok := out[0].(*big.Int)
+	if !ok {
+		return nil, fmt.Errorf("unexpected balance %v", out[0])
+	}
+	return bal, nil
+}
+
+func (t *erc20Token) call(ctx context.Context, client ethClient, method string, args ...interface{}) ([]interface{}, error) {
+	res, err := t.callRaw(ctx, client, method, args...)
+	if err != nil {
+		return nil, err
+	}
+	out, err := erc20ABI.Unpack(method, res)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode %s: %w", method, err)
+	}
+	return out, nil
+}
+
+func (t *erc20Token) callRaw(ctx context.Context, client ethClient, method string, args ...interface{}) ([]byte, error) {
+	data, err := erc20ABI.Pack(method, args...)
+	if err != nil {
+		return nil, err
+	}
+	res, err := client.CallContract(ctx, ethereum.CallMsg{To: &t.address, Data: data}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not call %s: %w", method, err)
+	}
+	return res, nil
+}
+
+// Builds the call transferring the token amount from the funder to the address,
+// with the gas the node estimates for it. Some tokens return false instead of
+// reverting a failed transfer, so the transfer is simulated first to catch them
+// before the request counts as funded.
+func (t *erc20Token) payment(ctx context.Context, client ethClient, from, to common.Address) (payment, error) {
+	data, err := erc20ABI.Pack("transfer", to, t.amount)
+	if err != nil {
+		return payment{}, fmt.Errorf("could not encode transfer: %w", err)
+	}
+	gas, err := client.EstimateGas(ctx, ethereum.CallMsg{From: from, To: &t.address, Data: data})
+	if err != nil {
+		return payment{}, fmt.Errorf("could not estimate gas: %w", err)
+	}
+	res, err := client.CallContract(ctx, ethereum.CallMsg{From: from, To: &t.address, Data: data}, nil)
+	if err != nil {
+		return payment{}, fmt.Errorf("could not call transfer: %w", err)
+	}
+	// Tokens predating the standard return nothing, and revert on failure.
+	if len(res) > 0 {
+		out, err := erc20ABI.Unpack("transfer", res)
+		if err != nil {
+			return payment{}, fmt.Errorf("could not decode transfer: %w", err)
+		}
+		if ok, _ := out[0].(bool); !ok {
+			return payment{}, errTransferRefused
+		}
+	}
+	return payment{to: t.address, value: new(big.Int), data: data, gas: gas}, nil
+}
+
+// Looks up the token requested by its name, or nil if ETH was requested.
+func (s *Server) lookupToken(asset string) (*erc20Token, error) {
+	name := strings.ToLower(asset)
+	if name == "" || name == ethAsset {
+		return nil, nil
+	}
+	t, ok := s.tokens[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown asset %q", asset)
+	}
+	return t, nil
+}
+
+// Formats an amount in base units as whole units of an asset with the decimals.
+func formatAmount(amount *big.Int, decimals uint8) string {
+	unit := new(big.Float).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(decimals)), nil))
+	return new(big.Float).Quo(new(big.Float).SetInt(amount), unit).String()
+}
@@ -0,0 +1,236 @@
+package internal
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/params"
+	faucetpb "github.com/rauljordan/eth-faucet/proto/faucet"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var testTokenAddress = common.HexToAddress("0x0202020202020202020202020202020202020202")
+
+func withDuration(d time.Duration) *time.Duration {
+	return &d
+}
+
+func newTestTokenServer(t *testing.T, client *fakeClient) *Server {
+	srv := newTestServer(t, newSimpleRateLimiter(testRateLimits(5, 5, time.Hour)), client)
+	srv.cfg.Tokens = []Token{{
+		Name:            "Test",
+		Address:         testTokenAddress.Hex(),
+		Amount:          "2500000",
+		AddressCooldown: withDuration(time.Hour),
+	}}
+	tokens, err := newTokens(srv.cfg, srv.rateLimiter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.tokens = tokens
+	return srv
+}
+
+func TestServer_RequestFunds_token(t *testing.T) {
+	client := &fakeClient{}
+	srv := newTestTokenServer(t, client)
+	ethAddress := "0x0101010101010101010101010101010101010101"
+	req := captchaFundingRequest(ethAddress)
+	req.Asset = "TEST"
+	resp, err := srv.RequestFunds(requestContext("192.0.0.1"), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Asset != "test" || resp.Symbol != "TST" || resp.Decimals != 6 || resp.Amount != "2.5" {
+		t.Errorf("Wanted 2.5 TST with 6 decimals, got %v", resp)
+	}
+
+	tx := client.sent[0]
+	if *tx.To() != testTokenAddress || tx.Value().Sign() != 0 || tx.Gas() != 51000 {
+		t.Errorf("Wanted a call of the token contract with estimated gas, got %v", tx)
+	}
+	args, err := erc20ABI.Methods["transfer"].Inputs.Unpack(tx.Data()[4:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if args[0].(common.Address) != common.HexToAddress(ethAddress) || args[1].(*big.Int).Cmp(big.NewInt(2500000)) != 0 {
+		t.Errorf("Wanted a transfer of 2500000 to %s, got %v", ethAddress, args)
+	}
+
+	// Token funding is limited apart from ETH funding.
+	if _, err := srv.RequestFunds(requestContext("192.0.0.1"), captchaFundingRequest(ethAddress)); err != nil {
+		t.Errorf("Wanted ETH funding to be allowed after token funding: %v", err)
+	}
+	req = captchaFundingRequest(ethAddress)
+	req.Asset = "test"
+	_, err = srv.RequestFunds(requestContext("192.0.0.1"), req)
+	requireDenied(t, err, addressCooldown)
+}
+
+func TestServer_RequestFunds_tokenFunderPool(t *testing.T) {
+	signers := generateFunderSigners(t, 3)
+	noTokens := signers[0].account()
+	noGas := signers[1].account()
+	funded := signers[2].account()
+	client := &fakeClient{
+		balances: map[common.Address]*big.Int{
+			noTokens: big.NewInt(2 * params.Ether),
+			noGas:    big.NewInt(1),
+		},
+		tokenBalances: map[common.Address]*big.Int{
+			noTokens: big.NewInt(1),
+			noGas:    big.NewInt(params.Ether),
+			funded:   big.NewInt(2500000),
+		},
+	}
+	srv := newTestTokenServer(t, client)
+	srv.funders = newFunderPool(client, signers, mostBalanceStrategy, big.NewInt(1000), srv.fundingAmount)
+
+	req := captchaFundingRequest("0x0101010101010101010101010101010101010101")
+	req.Asset = "test"
+	resp, err := srv.RequestFunds(requestContext("192.0.0.1"), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.FunderAddress != funded.Hex() {
+		t.Errorf("Wanted funder %s holding the tokens and gas, got %s", funded.Hex(), resp.FunderAddress)
+	}
+
+	client.tokenBalances[funded] = big.NewInt(1)
+	req = captchaFundingRequest("0x0202020202020202020202020202020202020202")
+	req.Asset = "test"
+	_, err = srv.RequestFunds(requestContext("192.0.0.2"), req)
+	if status.Code(err) != codes.Unavailable {
+		t.Errorf("Wanted token requests to fail once no funder holds the tokens, got %v", err)
+	}
+}
+
+func TestServer_RequestFunds_tokenRefusesTransfer(t *testing.T) {
+	client := &fakeClient{refusesTokens: true}
+	srv := newTestTokenServer(t, client)
+	ethAddress := "0x0101010101010101010101010101010101010101"
+	req := captchaFundingRequest(ethAddress)
+	req.Asset = "test"
+	if _, err := srv.RequestFunds(requestContext("192.0.0.1"), req); err == nil {
+		t.Fatal("Wanted a transfer the token refuses to fail the request")
+	}
+	if client.numSent() != 0 {
+		t.Errorf("Wanted no transaction to be sent, got %d", client.numSent())
+	}
+
+	// The refused request does not count against the limits.
+	client.refusesTokens = false
+	req = captchaFundingRequest(ethAddress)
+	req.Asset = "test"
+	if _, err := srv.RequestFunds(requestContext("192.0.0.1"), req); err != nil {
+		t.Errorf("Wanted funding to be allowed after a refused transfer: %v", err)
+	}
+}
+
+func TestServer_RequestFunds_unknownAsset(t *testing.T) {
+	srv := newTestTokenServer(t, &fakeClient{})
+	req := captchaFundingRequest("0x0101010101010101010101010101010101010101")
+	req.Asset = "dai"
+	_, err := srv.RequestFunds(requestContext("192.0.0.1"), req)
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Wanted unknown asset to be rejected, got %v", err)
+	}
+}
+
+func TestServer_RequestFunds_ethAsset(t *testing.T) {
+	srv := newTestTokenServer(t, &fakeClient{})
+	req := captchaFundingRequest("0x0101010101010101010101010101010101010101")
+	req.Asset = "ETH"
+	resp, err := srv.RequestFunds(requestContext("192.0.0.1"), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &faucetpb.FundingResponse{Amount: "1", Asset: ethAsset, Symbol: "ETH", Decimals: 18}
+	if resp.Amount != want.Amount || resp.Asset != want.Asset || resp.Symbol != want.Symbol || resp.Decimals != want.Decimals {
+		t.Errorf("Wanted %v, got %v", want, resp)
+	}
+}
+
+func Test_newTokens_invalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		token Token
+	}{
+		{name: "eth_name", token: Token{Name: "ETH", Address: testTokenAddress.Hex(), Amount: "1"}},
+		{name: "invalid_address", token: Token{Name: "test", Address: "0x01", Amount: "1"}},
+		{name: "zero_amount", token: Token{Name: "test", Address: testTokenAddress.Hex(), Amount: "0"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{Tokens: []Token{tt.token}}
+			if _, err := newTokens(cfg, newSimpleRateLimiter(newRateLimits(cfg))); err == nil {
+				t.Error("Wanted invalid token to be rejected")
+			}
+		})
+	}
+}
+
+func TestToken_limitsConfig(t *testing.T) {
+	cfg := &Config{
+		AddressCooldown:       time.Hour,
+		LimitWindow:           time.Hour,
+		IpLimitPerAddress:     3,
+		AddressLimitPerIP:     3,
+		AddressLimitPerSubnet: 10,
+	}
+	token := Token{
+		AddressCooldown:       withDuration(time.Minute),
+		AddressLimitPerIP:     withQuota(5),
+		AddressLimitPerSubnet: withQuota(0),
+	}
+	got := token.limitsConfig(cfg)
+	// Limits left out fall back to the faucet's, and 0 disables a limit.
+	if got.AddressCooldown != time.Minute || got.LimitWindow != time.Hour || got.IpLimitPerAddress != 3 ||
+		got.AddressLimitPerIP != 5 || got.AddressLimitPerSubnet != 0 {
+		t.Errorf("Wanted token limits over the faucet's, got %+v", got)
+	}
+	if cfg.AddressLimitPerSubnet != 10 {
+		t.Errorf("Wanted the faucet's limits to be left alone, got %+v", cfg)
+	}
+}
+
+func Test_newScopedRateLimiter(t *testing.T) {
+	for _, backend := range rateLimiterBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			base := backend.new(t, testRateLimits(3, 3, time.Hour))
+			limits := testRateLimits(3, 3, time.Hour)
+			limits.scope = "token:test"
+			scoped, err := newScopedRateLimiter(base, limits)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fund(t, base, "192.0.0.1", "0x0101")
+			if err := tryReserve(scoped, "192.0.0.1", "0x0101"); err != nil {
+				t.Errorf("Wanted scoped limits to be kept apart: %v", err)
+			}
+			fund(t, scoped, "192.0.0.1", "0x0101")
+			requireLimit(t, tryReserve(scoped, "192.0.0.1", "0x0101"), addressCooldown)
+		})
+	}
+}
+
+func Test_formatAmount(t *testing.T) {
+	tests := []struct {
+		amount   string
+		decimals uint8
+		want     string
+	}{
+		{amount: "1000000000000000000", decimals: 18, want: "1"},
+		{amount: "2500000", decimals: 6, want: "2.5"},
+		{amount: "42", decimals: 0, want: "42"},
+	}
+	for _, tt := range tests {
+		amount, _ := new(big.Int).SetString(tt.amount, 10)
+		if got := formatAmount(amount, tt.decimals); got != tt.want {
+			t.Errorf("formatAmount(%s, %d) = %s, want %s", tt.amount, tt.decimals, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package internal
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	errTokenUsed      = errors.New("captcha response was already used")
+	errUsedTokensFull = errors.New("too many captcha responses in use")
+)
+
+// Used token stores remember the captcha tokens and proof-of-work challenges
+// which were already redeemed until they expire, so each of them can only fund
+// a single request. Tokens are claimed before they are verified, so parallel
+// requests reusing a token cannot all pass verification. Stores are kept on the
+// backend of the rate limiter. The bolt database persists them across restarts
+// but is locked by a single process, so only replicas sharing a redis instance,
+// and proof-of-work secret, also share the tokens they redeemed.
+type usedTokenStore interface {
+	// Claims the token until it expires. Fails with errTokenUsed if it was
+	// already claimed.
+	claim(token string, expiresAt, now time.Time) error
+	// Releases a claimed token which failed verification, so it can be retried.
+	release(token string)
+	refresh(ctx context.Context)
+}
+
+// Initializes the used token store on the backend of the rate limiter.
+func newUsedTokenStore(cfg *Config, limiter rateLimiter) (usedTokenStore, error) {
+	switch l := limiter.(type) {
+	case *boltRateLimiter:
+		return newBoltUsedTokens(l.db)
+	case *redisRateLimiter:
+		return &redisUsedTokens{client: l.client}, nil
+	default:
+		return newUsedTokenCache(cfg.CaptchaReplayCacheSize), nil
+	}
+}
+
+// Used token cache keeps the tokens in memory. Once it holds max size tokens
+// which did not expire yet, further tokens are refused until some expire, as
+// evicting one would make it redeemable again.
+type usedTokenCache struct {
+	mutex   sync.Mutex
+	maxSize int
+	tokens  map[[sha256.Size]byte]*list.Element
+	order   *list.List
+}
+
+type usedToken struct {
+	hash      [sha256.Size]byte
+	expiresAt time.Time
+}
+
+func newUsedTokenCache(maxSize int) *usedTokenCache {
+	return &usedTokenCache{
+		maxSize: maxSize,
+		tokens:  make(map[[sha256.Size]byte]*list.Element),
+		order:   list.New(),
+	}
+}
+
+func (c *usedTokenCache) claim(token string, expiresAt, now time.Time) error {
+	hash := sha256.Sum256([]byte(token))
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.pruneExpired(now)
+	if el, ok := c.tokens[hash]; ok {
+		if now.Before(el.Value.(*usedToken).expiresAt) {
+			return errTokenUsed
+		}
+		c.remove(el)
+	}
+	if c.order.Len() >= c.maxSize {
+		// Tokens expire out of order when they have different lifetimes.
+		for el := c.order.Front(); el != nil; {
+			next := el.Next()
+			if !now.Before(el.Value.(*usedToken).expiresAt) {
+				c.remove(el)
+			}
+			el = next
+		}
+		if c.order.Len() >= c.maxSize {
+			return errUsedTokensFull
+		}
+	}
+	c.tokens[hash] = c.order.PushBack(&usedToken{hash: hash, expiresAt: expiresAt})
+	return nil
+}
+
+func (c *usedTokenCache) release(token string) {
+	hash := sha256.Sum256([]byte(token))
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if el, ok := c.tokens[hash]; ok {
+		c.remove(el)
+	}
+}
+
+// Expired tokens are pruned whenever a token is claimed.
+func (c *usedTokenCache) refresh(_ context.Context) {}
+
+// Evicts the oldest tokens as long as they expired. Requires the lock.
+func (c *usedTokenCache) pruneExpired(now time.Time) {
+	for el := c.order.Front(); el != nil && !now.Before(el.Value.(*usedToken).expiresAt); el = c.order.Front() {
+		c.remove(el)
+	}
+}
+
+func (c *usedTokenCache) remove(el *list.Element) {
+	delete(c.tokens, el.Value.(*usedToken).hash)
+	c.order.Remove(el)
+}
+
+var usedTokensBucket = []byte("used-tokens")
+
+// Keeps the tokens in the bolt database of the rate limiter, mapping the hash
+// of each token to when it expires.
+type boltUsedTokens struct {
+	db              *bolt.DB
+	refreshInterval time.Duration
+}
+
+func newBoltUsedTokens(db *bolt.DB) (*boltUsedTokens, error) {
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(usedTokensBucket)
+		return err
+	}); err != nil {
+		return nil, fmt.Errorf("could not initialize used tokens: %w", err)
+	}
+	return &boltUsedTokens{
+		db:              db,
+		refreshInterval: time.Hour, /* Prune expired tokens every hour */
+	}, nil
+}
+
+func (b *boltUsedTokens) claim(token string, expiresAt, now time.Time) error {
+	hash := sha256.Sum256([]byte(token))
+	used := false
+	if err := b.db.Update(func(tx *bolt.Tx) error {
+		tokens := tx.Bucket(usedTokensBucket)
+		if now.Before(decodeTime(tokens.Get(hash[:]))) {
+			used = true
+			return nil
+		}
+		return tokens.Put(hash[:], encodeTime(expiresAt))
+	}); err != nil {
+		return fmt.Errorf("could not claim token: %w", err)
+	}
+	if used {
+		return errTokenUsed
+	}
+	return nil
+}
+
+func (b *boltUsedTokens) release(token string) {
+	hash := sha256.Sum256([]byte(token))
+	if err := b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(usedTokensBucket).Delete(hash[:])
+	}); err != nil {
+		log.WithError(err).Error("Could not release used token")
+	}
+}
+
+// Prune expired tokens every so often.
+func (b *boltUsedTokens) refresh(ctx context.Context) {
+	ticker := time.NewTicker(b.refreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			if err := b.pruneExpired(now); err != nil {
+				log.WithError(err).Error("Could not prune used tokens")
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (b *boltUsedTokens) pruneExpired(now time.Time) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return deleteWhere(tx.Bucket(usedTokensBucket), func(expiresAt time.Time) bool {
+			return !now.Before(expiresAt)
+		})
+	})
+}
+
+const redisUsedTokenPrefix = "faucet:used-token:"
+
+// Keeps the tokens in the redis instance of the rate limiter, as keys which
+// redis expires along with the token.
+type redisUsedTokens struct {
+	client redis.UniversalClient
+}
+
+func (r *redisUsedTokens) claim(token string, expiresAt, now time.Time) error {
+	ttl := expiresAt.Sub(now)
+	if ttl <= 0 {
+		// Expired tokens fail verification, so there is nothing to remember.
+		return nil
+	}
+	ok, err := r.client.SetNX(context.Background(), redisUsedTokenKey(token), expiresAt.UnixNano(), ttl).Result()
+	if err != nil {
+		return fmt.Errorf("could not claim token: %w", err)
+	}
+	if !ok {
+		return errTokenUsed
+	}
+	return nil
+}
+
+func (r *redisUsedTokens) release(token string) {
+	if err := r.client.Del(context.Background(), redisUsedTokenKey(token)).Err(); err != nil {
+		log.WithError(err).Error("Could not release used token")
+	}
+}
+
+// Redis expires tokens on its own, so there is nothing to refresh.
+func (r *redisUsedTokens) refresh(_ context.Context) {}
+
+func redisUsedTokenKey(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return redisUsedTokenPrefix + hex.EncodeToString(hash[:])
+}
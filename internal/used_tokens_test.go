@@ -0,0 +1,109 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_usedTokenCache(t *testing.T) {
+	c := newUsedTokenCache(2)
+	now := time.Now()
+	expiresAt := now.Add(time.Minute)
+	if err := c.claim("a", expiresAt, now); err != nil {
+		t.Fatalf("Wanted first claim to succeed: %v", err)
+	}
+	if err := c.claim("a", expiresAt, now); !errors.Is(err, errTokenUsed) {
+		t.Errorf("Wanted second claim to fail, got %v", err)
+	}
+	c.release("a")
+	if err := c.claim("a", expiresAt, now); err != nil {
+		t.Errorf("Wanted claim of released token to succeed: %v", err)
+	}
+	if err := c.claim("a", expiresAt.Add(time.Minute), expiresAt); err != nil {
+		t.Errorf("Wanted claim of expired token to succeed: %v", err)
+	}
+
+	// Once the cache is full of unexpired tokens, new tokens are refused
+	// rather than evicting a token which could then be redeemed again.
+	c = newUsedTokenCache(2)
+	if err := c.claim("a", now.Add(time.Hour), now); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.claim("b", expiresAt, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.claim("c", expiresAt, now); !errors.Is(err, errUsedTokensFull) {
+		t.Errorf("Wanted claim on a full cache to be refused, got %v", err)
+	}
+	if err := c.claim("a", now.Add(time.Hour), now); !errors.Is(err, errTokenUsed) {
+		t.Errorf("Wanted used token to stay used, got %v", err)
+	}
+	// Tokens expiring after newer ones still make room once they expire.
+	if err := c.claim("c", expiresAt.Add(time.Minute), expiresAt); err != nil {
+		t.Errorf("Wanted claim to succeed once a token expired: %v", err)
+	}
+}
+
+func Test_usedTokenCache_concurrentClaims(t *testing.T) {
+	c := newUsedTokenCache(100)
+	now := time.Now()
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	claimed := make(map[string]int)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			token := fmt.Sprintf("token-%d", i%5)
+			if c.claim(token, now.Add(time.Minute), now) == nil {
+				mutex.Lock()
+				claimed[token]++
+				mutex.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	for token, n := range claimed {
+		if n != 1 {
+			t.Errorf("Wanted %s claimed once, got %d", token, n)
+		}
+	}
+	if len(claimed) != 5 {
+		t.Errorf("Wanted 5 tokens claimed, got %d", len(claimed))
+	}
+}
+
+func Test_usedTokenStore_sharedBackends(t *testing.T) {
+	for _, backend := range rateLimiterBackends {
+		if backend.name == memoryRateLimiterBackend {
+			continue
+		}
+		t.Run(backend.name, func(t *testing.T) {
+			rl := backend.new(t, testRateLimits(3, 3, time.Hour))
+			// Two stores sharing the backend within one process, as only a
+			// redis instance can be shared between replicas.
+			first, err := newUsedTokenStore(&Config{}, rl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			second, err := newUsedTokenStore(&Config{}, rl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			now := time.Now()
+			if err := first.claim("a", now.Add(time.Minute), now); err != nil {
+				t.Fatal(err)
+			}
+			if err := second.claim("a", now.Add(time.Minute), now); !errors.Is(err, errTokenUsed) {
+				t.Errorf("Wanted token used on one store to be refused on another, got %v", err)
+			}
+			first.release("a")
+			if err := second.claim("a", now.Add(time.Minute), now); err != nil {
+				t.Errorf("Wanted released token to be claimable: %v", err)
+			}
+		})
+	}
+}
@@ -18,6 +18,8 @@ const _ = grpc.SupportPackageIsVersion7
 // For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
 type FaucetClient interface {
 	RequestFunds(ctx context.Context, in *FundingRequest, opts ...grpc.CallOption) (*FundingResponse, error)
+	RequestChallenge(ctx context.Context, in *ChallengeRequest, opts ...grpc.CallOption) (*ChallengeResponse, error)
+	GetFundingStatus(ctx context.Context, in *FundingStatusRequest, opts ...grpc.CallOption) (*FundingStatusResponse, error)
 }
 
 type faucetClient struct {
@@ -37,11 +39,31 @@ func (c *faucetClient) RequestFunds(ctx context.Context, in *FundingRequest, opt
 	return out, nil
 }
 
+func (c *faucetClient) RequestChallenge(ctx context.Context, in *ChallengeRequest, opts ...grpc.CallOption) (*ChallengeResponse, error) {
+	out := new(ChallengeResponse)
+	err := c.cc.Invoke(ctx, "/faucet.Faucet/RequestChallenge", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *faucetClient) GetFundingStatus(ctx context.Context, in *FundingStatusRequest, opts ...grpc.CallOption) (*FundingStatusResponse, error) {
+	out := new(FundingStatusResponse)
+	err := c.cc.Invoke(ctx, "/faucet.Faucet/GetFundingStatus", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // FaucetServer is the server API for Faucet service.
 // All implementations must embed UnimplementedFaucetServer
 // for forward compatibility
 type FaucetServer interface {
 	RequestFunds(context.Context, *FundingRequest) (*FundingResponse, error)
+	RequestChallenge(context.Context, *ChallengeRequest) (*ChallengeResponse, error)
+	GetFundingStatus(context.Context, *FundingStatusRequest) (*FundingStatusResponse, error)
 	mustEmbedUnimplementedFaucetServer()
 }
 
@@ -52,6 +74,12 @@ type UnimplementedFaucetServer struct {
 func (UnimplementedFaucetServer) RequestFunds(context.Context, *FundingRequest) (*FundingResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method RequestFunds not implemented")
 }
+func (UnimplementedFaucetServer) RequestChallenge(context.Context, *ChallengeRequest) (*ChallengeResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RequestChallenge not implemented")
+}
+func (UnimplementedFaucetServer) GetFundingStatus(context.Context, *FundingStatusRequest) (*FundingStatusResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetFundingStatus not implemented")
+}
 func (UnimplementedFaucetServer) mustEmbedUnimplementedFaucetServer() {}
 
 // UnsafeFaucetServer may be embedded to opt out of forward compatibility for this service.
@@ -83,6 +111,42 @@ func _Faucet_RequestFunds_Handler(srv interface{}, ctx context.Context, dec func
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Faucet_RequestChallenge_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ChallengeRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FaucetServer).RequestChallenge(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/faucet.Faucet/RequestChallenge",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FaucetServer).RequestChallenge(ctx, req.(*ChallengeRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Faucet_GetFundingStatus_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(FundingStatusRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FaucetServer).GetFundingStatus(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/faucet.Faucet/GetFundingStatus",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FaucetServer).GetFundingStatus(ctx, req.(*FundingStatusRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 var _Faucet_serviceDesc = grpc.ServiceDesc{
 	ServiceName: "faucet.Faucet",
 	HandlerType: (*FaucetServer)(nil),
@@ -91,6 +155,14 @@ var _Faucet_serviceDesc = grpc.ServiceDesc{
 			MethodName: "RequestFunds",
 			Handler:    _Faucet_RequestFunds_Handler,
 		},
+		{
+			MethodName: "RequestChallenge",
+			Handler:    _Faucet_RequestChallenge_Handler,
+		},
+		{
+			MethodName: "GetFundingStatus",
+			Handler:    _Faucet_GetFundingStatus_Handler,
+		},
 	},
 	Streams:  []grpc.StreamDesc{},
 	Metadata: "faucet/faucet.proto",